@@ -0,0 +1,129 @@
+package kodocli
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"hash"
+	"io"
+	"os"
+)
+
+// 本地计算的 etag 与服务端返回的 hash 不一致
+var ErrEtagNotMatch = errors.New("etag not match")
+
+// 计算七牛 etag 时使用的块大小
+const EtagBlockSize = 1 << 22
+
+// 七牛 etag 计算器，实现了 io.Writer，可以边读边算
+//
+// 数据不超过 4MB 时，etag 为 0x16 加上数据的 SHA1；
+// 否则按 4MB 分块，etag 为 0x96 加上所有块 SHA1 拼接后的 SHA1，最后均做 URL 安全的 Base64 编码。
+type EtagHasher struct {
+	block     hash.Hash
+	blockSize int64
+	sums      []byte
+}
+
+// 创建七牛 etag 计算器
+func NewEtagHasher() *EtagHasher {
+	return &EtagHasher{block: sha1.New()}
+}
+
+func (h *EtagHasher) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		size := int64(len(p))
+		if rest := EtagBlockSize - h.blockSize; size > rest {
+			size = rest
+		}
+		h.block.Write(p[:size])
+		h.blockSize += size
+		p = p[size:]
+		if h.blockSize == EtagBlockSize {
+			h.sums = h.block.Sum(h.sums)
+			h.block.Reset()
+			h.blockSize = 0
+		}
+	}
+	return n, nil
+}
+
+// 获取已写入数据的 etag
+func (h *EtagHasher) Etag() string {
+	return etagOfBlockSums(h.blockSums())
+}
+
+// 已写入数据每个块的 SHA1 拼接的结果，最后不满一块的数据也单独作为一块
+func (h *EtagHasher) blockSums() []byte {
+	if h.blockSize > 0 {
+		return h.block.Sum(h.sums[:len(h.sums):len(h.sums)])
+	}
+	return h.sums
+}
+
+// 根据按顺序拼接的所有块的 SHA1 计算 etag，用于分别计算各个分片的块 SHA1 后合并
+func etagOfBlockSums(sums []byte) string {
+	if len(sums) == 0 {
+		sum := sha1.Sum(nil)
+		sums = sum[:]
+	}
+	var result []byte
+	if len(sums) == sha1.Size {
+		result = append([]byte{0x16}, sums...)
+	} else {
+		sum := sha1.Sum(sums)
+		result = append([]byte{0x96}, sum[:]...)
+	}
+	return base64.URLEncoding.EncodeToString(result)
+}
+
+// 计算 Reader 中全部数据的七牛 etag
+func GetEtag(r io.Reader) (string, error) {
+	h := NewEtagHasher()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return h.Etag(), nil
+}
+
+// 计算本地文件的七牛 etag
+func GetFileEtag(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	return GetEtag(f)
+}
+
+// 除最后一个分片外，分片大小都是 EtagBlockSize 的整数倍时，分片上传的结果 hash 才是标准的七牛 etag
+func etagCompatible(partSizes []int64) bool {
+	for i := 0; i < len(partSizes)-1; i++ {
+		if partSizes[i]%EtagBlockSize != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// 将服务端的返回解析到 ret 中，并检查其中的 hash 是否与本地计算的 etag 一致，返回中没有 hash 时不检查
+func decodeRetAndVerifyEtag(raw json.RawMessage, ret interface{}, etag string) error {
+	if len(raw) == 0 {
+		return nil
+	}
+	if ret != nil {
+		if err := json.Unmarshal(raw, ret); err != nil {
+			return err
+		}
+	}
+	var hashRet struct {
+		Hash string `json:"hash"`
+	}
+	if json.Unmarshal(raw, &hashRet) == nil && hashRet.Hash != "" && hashRet.Hash != etag {
+		elog.Warn("etag not match, local:", etag, "remote:", hashRet.Hash)
+		return ErrEtagNotMatch
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+package kodocli
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"testing"
+)
+
+func TestGetEtag(t *testing.T) {
+	cases := map[string]string{
+		"":     "Fto5o-5ea0sNMlW_75VgGJCv2AcJ",
+		"etag": "FpLiADEaVoALPkdb8tJEJyRTXoe_",
+	}
+	for data, expected := range cases {
+		etag, err := GetEtag(bytes.NewReader([]byte(data)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if etag != expected {
+			t.Fatalf("unexpected etag of %q: %s, expect: %s", data, etag, expected)
+		}
+	}
+
+	data := bytes.Repeat([]byte("0123456789"), EtagBlockSize/5)
+	first := sha1.Sum(data[:EtagBlockSize])
+	second := sha1.Sum(data[EtagBlockSize:])
+	sum := sha1.Sum(append(first[:], second[:]...))
+	expected := base64.URLEncoding.EncodeToString(append([]byte{0x96}, sum[:]...))
+
+	h := NewEtagHasher()
+	for i := 0; i < len(data); i += 1000 {
+		end := i + 1000
+		if end > len(data) {
+			end = len(data)
+		}
+		h.Write(data[i:end])
+	}
+	if etag := h.Etag(); etag != expected {
+		t.Fatalf("unexpected etag: %s, expect: %s", etag, expected)
+	}
+	if etag, _ := GetEtag(bytes.NewReader(data[:EtagBlockSize])); etag != base64.URLEncoding.EncodeToString(append([]byte{0x16}, first[:]...)) {
+		t.Fatalf("unexpected etag of single block: %s", etag)
+	}
+}
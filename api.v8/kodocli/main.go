@@ -5,6 +5,7 @@ import (
 	"time"
 
 	"github.com/qiniupd/qiniu-go-sdk/api.v7/conf"
+	"github.com/qiniupd/qiniu-go-sdk/api.v8/limit"
 	"github.com/qiniupd/qiniu-go-sdk/x/rpc.v7"
 	"github.com/qiniupd/qiniu-go-sdk/x/url.v7"
 )
@@ -42,14 +43,47 @@ type UploadConfig struct {
 	UploadPartSize int64
 	Concurrency    int
 	UseBuffer      bool
+	// 可选，对上传时从数据源读取的字节数限速，通常同时传入全局和集群的限速器
+	RateLimiters []*limit.RateLimiter
+	// 可选，是否在本地计算 etag 并与服务端返回的 hash 比较，见 Uploader.VerifyEtag
+	VerifyEtag bool
+	// 可选，流式上传时最多缓存的字节数，见 Uploader.StreamMemoryLimit
+	StreamMemoryLimit int64
+	// 可选，单个上传请求的超时时间，对所有上传协议生效，为 0 时取 10 分钟
+	Timeout time.Duration
+	// 可选，分片上传时预读的分片数，见 Uploader.ReadAhead
+	ReadAhead int
 }
 
+// 上传客户端，可以被多个 goroutine 并发使用，包括同时使用不同的上传凭证上传。
+// 上传凭证只附加在每次调用发起的请求上，不会修改 Conn；字段需要在开始使用前设置好。
 type Uploader struct {
 	Conn           rpc.Client
 	UpHosts        []string
 	UploadPartSize int64
 	Concurrency    int
 	UseBuffer      bool
+	RateLimiters   []*limit.RateLimiter
+	// 为 true 时在本地计算整个文件的 etag，与服务端返回的 hash 不一致时返回 ErrEtagNotMatch
+	// 分片上传时只有分片大小都是 EtagBlockSize 的整数倍才会检查，目前支持 Put2、Upload 系列和 StreamUpload 系列；
+	// 分片上传时 etag 在读取分片上传的同时计算，不会单独再读取一遍文件；
+	// Put2 会在上传前先读取一遍 data 计算 etag（和 crc32），之后每次上传尝试再各读取一遍
+	VerifyEtag bool
+	// 流式上传时最多缓存的字节数，按分片大小向下取整且至少缓存一个分片，为 0 时缓存的分片数等于并发数
+	StreamMemoryLimit int64
+	// 为 true 时分片上传失败不删除已经上传的分片，可以通过 UploadWithSession 获取会话，之后调用 ResumeUpload 继续上传
+	KeepSessionOnFailure bool
+	// 分片上传（Upload 系列和 ResumeUpload）时预读的分片数，为 0 时不预读。
+	// 大于 0 时按顺序读取分片，读取、计算 MD5 和上传同时进行，最多占用 Concurrency + ReadAhead 个分片大小的内存
+	ReadAhead int
+
+	// 可选，分片（或 Put2 的整个文件）上传进度通知，uploaded 为该分片本次尝试已发送的字节数。
+	// 这个事件的回调函数应该尽可能快地结束，并且可能被并发调用。
+	OnPartProgress func(partNum int, upHost string, uploaded int64)
+	// 可选，分片上传失败即将重试时的通知，可能被并发调用。
+	OnPartRetry func(partNum int, upHost string, err error)
+	// 可选，流式上传从数据源读取完一个分片后的通知，size 为分片大小，按分片顺序调用。
+	OnStreamPartRead func(partNum int, size int64)
 }
 
 func NewUploader(zone int, cfg *UploadConfig) (p Uploader) {
@@ -78,8 +112,16 @@ func NewUploader(zone int, cfg *UploadConfig) (p Uploader) {
 	}
 
 	p.UseBuffer = uc.UseBuffer
+	p.RateLimiters = uc.RateLimiters
+	p.VerifyEtag = uc.VerifyEtag
+	p.StreamMemoryLimit = uc.StreamMemoryLimit
+	p.ReadAhead = uc.ReadAhead
 	p.UpHosts = uc.UpHosts
-	p.Conn.Client = &http.Client{Transport: uc.Transport, Timeout: 10 * time.Minute}
+	timeout := uc.Timeout
+	if timeout == 0 {
+		timeout = 10 * time.Minute
+	}
+	p.Conn.Client = &http.Client{Transport: uc.Transport, Timeout: timeout}
 
 	p.shuffleUpHosts()
 	return
@@ -30,8 +30,8 @@ const (
 )
 
 type Settings struct {
-	TaskQsize int // 可选。任务队列大小。为 0 表示取 Workers * 4。
-	Workers   int // 并行 Goroutine 数目。
+	TaskQsize int // 已废弃。每次上传使用独立的并发控制，不再使用任务队列。
+	Workers   int // 默认每次上传并行上传的块数。
 	ChunkSize int // 默认的Chunk大小，不设定则为256k
 	TryTimes  int // 默认的尝试次数，不设定则为3
 }
@@ -62,23 +62,6 @@ func SetSettings(v *Settings) {
 
 // ----------------------------------------------------------
 
-var tasks chan func()
-
-func worker(tasks chan func()) {
-	for {
-		task := <-tasks
-		task()
-	}
-}
-
-func initWorkers() {
-
-	tasks = make(chan func(), settings.TaskQsize)
-	for i := 0; i < settings.Workers; i++ {
-		go worker(tasks)
-	}
-}
-
 func notifyNil(blkIdx int, blkSize int, ret *BlkputRet) {}
 func notifyErrNil(blkIdx int, blkSize int, err error)   {}
 
@@ -109,12 +92,33 @@ type RputExtra struct {
 	MimeType   string                                        // 可选。
 	ChunkSize  int                                           // 可选。每次上传的Chunk大小
 	TryTimes   int                                           // 可选。尝试次数
-	Progresses []BlkputRet                                   // 可选。上传进度
+	Progresses []BlkputRet                                   // 可选。上传进度，可以设置为之前保存的 ProgressSnapshot 继续上传
 	Notify     func(blkIdx int, blkSize int, ret *BlkputRet) // 可选。进度提示（注意多个block是并行传输的）
 	NotifyErr  func(blkIdx int, blkSize int, err error)
+	Workers    int                                           // 可选。并行上传的块数，为 0 时取 Uploader.Concurrency，仍为 0 时取 Settings.Workers
+
+	lock sync.Mutex
 }
 
-var once sync.Once
+// 返回当前上传进度的副本，上传过程中（包括在 Notify 中）也可以安全调用。
+// 结果可以序列化为 JSON 保存，之后设置到 Progresses 中继续上传，已经上传的块不会重新上传。
+func (extra *RputExtra) ProgressSnapshot() []BlkputRet {
+	extra.lock.Lock()
+	defer extra.lock.Unlock()
+	return append([]BlkputRet(nil), extra.Progresses...)
+}
+
+func (extra *RputExtra) progress(blkIdx int) BlkputRet {
+	extra.lock.Lock()
+	defer extra.lock.Unlock()
+	return extra.Progresses[blkIdx]
+}
+
+func (extra *RputExtra) setProgress(blkIdx int, ret *BlkputRet) {
+	extra.lock.Lock()
+	defer extra.lock.Unlock()
+	extra.Progresses[blkIdx] = *ret
+}
 
 // ----------------------------------------------------------
 
@@ -189,8 +193,6 @@ func (p Uploader) rput(
 	ctx Context, ret interface{}, uptoken string,
 	key string, hasKey bool, f io.ReaderAt, fsize int64, extra *RputExtra) error {
 
-	once.Do(initWorkers)
-
 	xl := xlog.NewWith(ctx)
 	blockCnt := BlockCount(fsize)
 
@@ -202,6 +204,11 @@ func (p Uploader) rput(
 	} else if len(extra.Progresses) != blockCnt {
 		return ErrInvalidPutProgress
 	}
+	for blkIdx, prog := range extra.Progresses {
+		if int64(prog.Offset) > fsize-int64(blkIdx)<<blockBits || prog.Offset > 1<<blockBits {
+			return ErrInvalidPutProgress
+		}
+	}
 
 	if extra.ChunkSize == 0 {
 		extra.ChunkSize = settings.ChunkSize
@@ -215,48 +222,92 @@ func (p Uploader) rput(
 	if extra.NotifyErr == nil {
 		extra.NotifyErr = notifyErrNil
 	}
-
-	var wg sync.WaitGroup
-	wg.Add(blockCnt)
+	workers := extra.Workers
+	if workers == 0 {
+		workers = p.Concurrency
+	}
+	if workers == 0 {
+		workers = settings.Workers
+	}
+	if workers > blockCnt {
+		workers = blockCnt
+	}
 
 	last := blockCnt - 1
 	blkSize := 1 << blockBits
-	nfails := 0
-	p.Conn.Client = newUptokenClient(uptoken, p.Conn.Transport)
-	failedUpHosts := make(map[string]struct{})
-
-	for i := 0; i < blockCnt; i++ {
-		blkIdx := i
+	ctx = withUptoken(ctx, uptoken)
+
+	var (
+		lock          sync.Mutex // 保护 failedUpHosts 和 nfails
+		failedUpHosts = make(map[string]struct{})
+		nfails        = 0
+	)
+	chooseUpHost := func() string {
+		lock.Lock()
+		defer lock.Unlock()
+		return p.chooseUpHost(failedUpHosts)
+	}
+	putBlock := func(blkIdx int) {
 		blkSize1 := blkSize
-		if i == last {
+		if blkIdx == last {
 			offbase := int64(blkIdx) << blockBits
 			blkSize1 = int(fsize - offbase)
 		}
-		task := func() {
-			defer wg.Done()
-			tryTimes := extra.TryTimes
-		lzRetry:
-			upHost := p.chooseUpHost(failedUpHosts)
-			err := p.resumableBput(ctx, upHost, &extra.Progresses[blkIdx], f, blkIdx, blkSize1, extra)
-			if err != nil {
-				failedUpHosts[upHost] = struct{}{}
-				failHostName(upHost)
-				if tryTimes > 1 {
-					tryTimes--
-					elog.Info(xl.ReqId, "resumable.Put retrying ...")
-					goto lzRetry
-				}
-				elog.Warn(xl.ReqId, "resumable.Put", blkIdx, "failed:", err)
-				extra.NotifyErr(blkIdx, blkSize1, err)
-				nfails++
-			} else {
+		tryTimes := extra.TryTimes
+		for {
+			upHost := chooseUpHost()
+			prog := extra.progress(blkIdx)
+			err := p.resumableBput(ctx, upHost, &prog, f, blkIdx, blkSize1, extra)
+			if err == nil {
 				succeedHostName(upHost)
+				return
+			}
+			if ctx.Err() != nil {
+				return
+			}
+			lock.Lock()
+			failedUpHosts[upHost] = struct{}{}
+			lock.Unlock()
+			failHostName(upHost)
+			if tryTimes > 1 {
+				tryTimes--
+				elog.Info(xl.ReqId, "resumable.Put retrying ...")
+				continue
 			}
+			elog.Warn(xl.ReqId, "resumable.Put", blkIdx, "failed:", err)
+			extra.NotifyErr(blkIdx, blkSize1, err)
+			lock.Lock()
+			nfails++
+			lock.Unlock()
+			return
 		}
-		tasks <- task
 	}
 
+	var wg sync.WaitGroup
+	blkIdxs := make(chan int)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for blkIdx := range blkIdxs {
+				putBlock(blkIdx)
+			}
+		}()
+	}
+dispatch:
+	for i := 0; i < blockCnt; i++ {
+		select {
+		case blkIdxs <- i:
+		case <-ctx.Done():
+			break dispatch
+		}
+	}
+	close(blkIdxs)
 	wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	if nfails != 0 {
 		return ErrPutFailed
 	}
@@ -2,12 +2,12 @@ package kodocli
 
 import (
 	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"hash/crc32"
 	"io"
-	"net/http"
+	"io/ioutil"
 	"strconv"
-	"time"
 
 	"github.com/qiniupd/qiniu-go-sdk/x/bytes.v7"
 	"github.com/qiniupd/qiniu-go-sdk/x/rpc.v7"
@@ -18,30 +18,41 @@ import (
 
 // ----------------------------------------------------------
 
-type uptokenTransport struct {
-	token     string
-	Transport http.RoundTripper
-}
+func (p Uploader) callWith(
+	ctx Context, ret interface{}, method, url1, bodyType string, body io.Reader, bodyLength int) error {
 
-func (t *uptokenTransport) NestedObject() interface{} {
-	return t.Transport
+	req, err := rpc.NewRequest(method, url1, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", bodyType)
+	req.ContentLength = int64(bodyLength)
+	if seeker, ok := body.(io.ReadSeeker); ok {
+		// 可以从头读取的请求体在上传凭证失效时可以直接重发
+		req.GetBody = func() (io.ReadCloser, error) {
+			if _, err := seeker.Seek(0, io.SeekStart); err != nil {
+				return nil, err
+			}
+			return ioutil.NopCloser(seeker), nil
+		}
+	}
+	resp, err := p.do(ctx, req)
+	if err != nil {
+		return err
+	}
+	return rpc.CallRet(ctx, ret, resp)
 }
 
-func (t *uptokenTransport) RoundTrip(req *http.Request) (resp *http.Response, err error) {
-	req.Header.Set("Authorization", t.token)
-	return t.Transport.RoundTrip(req)
+func (p Uploader) call(ctx Context, ret interface{}, method, url1 string) error {
+	return p.callWith(ctx, ret, method, url1, "application/x-www-form-urlencoded", nil, 0)
 }
 
-func newUptokenTransport(token string, transport http.RoundTripper) *uptokenTransport {
-	if transport == nil {
-		transport = http.DefaultTransport
+func (p Uploader) callWithJson(ctx Context, ret interface{}, method, url1 string, param interface{}) error {
+	msg, err := json.Marshal(param)
+	if err != nil {
+		return err
 	}
-	return &uptokenTransport{"UpToken " + token, transport}
-}
-
-func newUptokenClient(token string, transport http.RoundTripper) *http.Client {
-	t := newUptokenTransport(token, transport)
-	return &http.Client{Transport: t, Timeout: 10 * time.Minute}
+	return p.callWith(ctx, ret, method, url1, "application/json", bytes.NewReader(msg), len(msg))
 }
 
 // ----------------------------------------------------------
@@ -50,14 +61,14 @@ func (p Uploader) mkblk(
 	ctx Context, host string, ret *BlkputRet, blockSize int, body io.Reader, size int) error {
 
 	url := host + "/mkblk/" + strconv.Itoa(blockSize)
-	return p.Conn.CallWith(ctx, ret, "POST", url, "application/octet-stream", body, size)
+	return p.callWith(ctx, ret, "POST", url, "application/octet-stream", p.withRateLimit(ctx, body), size)
 }
 
 func (p Uploader) bput(
 	ctx Context, ret *BlkputRet, body io.Reader, size int) error {
 
 	url := ret.Host + "/bput/" + ret.Ctx + "/" + strconv.FormatUint(uint64(ret.Offset), 10)
-	return p.Conn.CallWith(ctx, ret, "POST", url, "application/octet-stream", body, size)
+	return p.callWith(ctx, ret, "POST", url, "application/octet-stream", p.withRateLimit(ctx, body), size)
 }
 
 // ----------------------------------------------------------
@@ -91,6 +102,7 @@ func (p Uploader) resumableBput(
 			err = ErrUnmatchedChecksum
 			return
 		}
+		extra.setProgress(blkIdx, ret)
 		extra.Notify(blkIdx, blkSize, ret)
 	}
 
@@ -112,6 +124,7 @@ func (p Uploader) resumableBput(
 		err = p.bput(ctx, ret, body, bodyLength)
 		if err == nil {
 			if ret.Crc32 == h.Sum32() {
+				extra.setProgress(blkIdx, ret)
 				extra.Notify(blkIdx, blkSize, ret)
 				continue
 			}
@@ -120,6 +133,7 @@ func (p Uploader) resumableBput(
 		} else {
 			if ei, ok := err.(*rpc.ErrorInfo); ok && ei.Code == InvalidCtx {
 				ret.Ctx = "" // reset
+				extra.setProgress(blkIdx, ret)
 				elog.Warn(xl.ReqId, "ResumableBlockput: invalid ctx, please retry")
 				return
 			}
@@ -156,8 +170,9 @@ func (p Uploader) mkfile(
 			url += "/x-qn-meta-" + k + "/" + base64.URLEncoding.EncodeToString([]byte(v))
 		}
 	}
-	buf := make([]byte, 0, 176*len(extra.Progresses))
-	for _, prog := range extra.Progresses {
+	progresses := extra.ProgressSnapshot()
+	buf := make([]byte, 0, 176*len(progresses))
+	for _, prog := range progresses {
 		buf = append(buf, prog.Ctx...)
 		buf = append(buf, ',')
 	}
@@ -165,7 +180,7 @@ func (p Uploader) mkfile(
 		buf = buf[:len(buf)-1]
 	}
 
-	return p.Conn.CallWith(
+	return p.callWith(
 		ctx, ret, "POST", url, "application/octet-stream", bytes.NewReader(buf), len(buf))
 }
 
@@ -0,0 +1,78 @@
+package kodocli
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/qiniupd/qiniu-go-sdk/api.v8/limit"
+)
+
+func TestRputResume(t *testing.T) {
+	server := newFakeUpServer()
+	defer server.Close()
+	up := NewUploader(0, &UploadConfig{UpHosts: []string{server.URL}})
+
+	data := bytes.Repeat([]byte("0123456789abcdef"), 4<<blockBits/16+100)
+	ctx, cancel := context.WithCancel(context.Background())
+	extra := RputExtra{ChunkSize: 1 << 20, Workers: 1}
+	var saved []byte
+	extra.Notify = func(blkIdx int, blkSize int, ret *BlkputRet) {
+		if blkIdx == 1 && int(ret.Offset) == blkSize {
+			saved, _ = json.Marshal(extra.ProgressSnapshot())
+			cancel()
+		}
+	}
+	err := up.Rput(ctx, nil, fakeUptoken("bucket"), "key", bytes.NewReader(data), int64(len(data)), &extra)
+	if err != context.Canceled {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if server.mkblks != 2 {
+		t.Fatalf("unexpected mkblk count: %d", server.mkblks)
+	}
+
+	var progresses []BlkputRet
+	if err = json.Unmarshal(saved, &progresses); err != nil {
+		t.Fatal(err)
+	}
+	var ret PutRet
+	err = up.Rput(context.Background(), &ret, fakeUptoken("bucket"), "key", bytes.NewReader(data), int64(len(data)), &RputExtra{Progresses: progresses})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(server.completed, data) {
+		t.Fatal("completed data is not equal")
+	}
+	if server.mkblks != 5 {
+		t.Fatalf("uploaded blocks are uploaded again: %d", server.mkblks)
+	}
+	if etag, _ := GetEtag(bytes.NewReader(data)); ret.Hash != etag {
+		t.Fatalf("unexpected hash: %s", ret.Hash)
+	}
+
+	if err = up.Rput(context.Background(), nil, fakeUptoken("bucket"), "key", bytes.NewReader(data), int64(len(data)), &RputExtra{Progresses: progresses[1:]}); err != ErrInvalidPutProgress {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestRputRateLimit(t *testing.T) {
+	server := newFakeUpServer()
+	defer server.Close()
+	// 桶初始为空，256KB 按 512KB/s 上传至少需要 0.5 秒
+	up := NewUploader(0, &UploadConfig{UpHosts: []string{server.URL}, RateLimiters: []*limit.RateLimiter{limit.NewRateLimiter(512*1024, 0)}})
+
+	data := bytes.Repeat([]byte("0123456789abcdef"), 256*1024/16)
+	start := time.Now()
+	err := up.Rput(context.Background(), nil, fakeUptoken("bucket"), "key", bytes.NewReader(data), int64(len(data)), &RputExtra{ChunkSize: 64 * 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Fatalf("upload is not throttled: %v", elapsed)
+	}
+	if !bytes.Equal(server.completed, data) {
+		t.Fatal("completed data is not equal")
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"context"
 	"crypto/md5"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -29,17 +30,22 @@ const completePartsRetryTimes = 5
 
 var ErrMd5NotMatch = httputil.NewError(406, "md5 not match")
 
+// 流式分片上传不支持空数据，空数据可以使用 PutReader 上传
+var ErrEmptyStream = errors.New("can't upload empty stream, use PutReader instead")
+
 //https://github.com/qbox/product/blob/master/kodo/resumable-up-v2/init_parts.md
-func (p Uploader) initParts(ctx context.Context, host, bucket, key string, hasKey bool) (uploadId string, suggestedPartSize int64, err error) {
+func (p Uploader) initParts(ctx context.Context, host, bucket, key string, hasKey bool) (uploadId string, suggestedPartSize, expireAt int64, err error) {
 	url1 := fmt.Sprintf("%s/buckets/%s/objects/%s/uploads", host, bucket, encodeKey(key, hasKey))
 	ret := struct {
 		UploadId          string `json:"uploadId"`
 		SuggestedPartSize int64  `json:"suggestedPartSize,omitempty"`
+		ExpireAt          int64  `json:"expireAt,omitempty"`
 	}{}
 
-	err = p.Conn.Call(ctx, &ret, "POST", url1)
+	err = p.call(ctx, &ret, "POST", url1)
 	uploadId = ret.UploadId
 	suggestedPartSize = ret.SuggestedPartSize
+	expireAt = ret.ExpireAt
 	return
 }
 
@@ -49,17 +55,25 @@ type UploadPartRet struct {
 }
 
 //https://github.com/qbox/product/blob/master/kodo/resumable-up-v2/upload_parts.md
-func (p Uploader) uploadPart(ctx context.Context, host, bucket, key string, hasKey bool, uploadId string, partNum int, body io.Reader, bodyLen int) (ret UploadPartRet, err error) {
+// partMd5 为预先计算的分片 MD5，为空时在上传的同时计算
+func (p Uploader) uploadPart(ctx context.Context, host, bucket, key string, hasKey bool, uploadId string, partNum int, body io.Reader, bodyLen int,
+	partMd5 string) (ret UploadPartRet, err error) {
 	url1 := fmt.Sprintf("%s/buckets/%s/objects/%s/uploads/%s/%d", host, bucket, encodeKey(key, hasKey), uploadId, partNum)
 	h := md5.New()
-	tr := io.TeeReader(body, h)
+	body = p.withRateLimit(ctx, body)
+	if partMd5 == "" {
+		body = io.TeeReader(body, h)
+	}
+	tr := p.withPartProgress(body, partNum, host)
 
-	err = p.Conn.CallWith(ctx, &ret, "PUT", url1, "application/octet-stream", tr, bodyLen)
+	err = p.callWith(ctx, &ret, "PUT", url1, "application/octet-stream", tr, bodyLen)
 	if err != nil {
 		return
 	}
 
-	partMd5 := hex.EncodeToString(h.Sum(nil))
+	if partMd5 == "" {
+		partMd5 = hex.EncodeToString(h.Sum(nil))
+	}
 	if partMd5 != ret.Md5 {
 		err = ErrMd5NotMatch
 	}
@@ -92,7 +106,7 @@ func (p Uploader) completeParts(ctx context.Context, host string, ret interface{
 	mp.Metadata = metaData
 
 	url1 := fmt.Sprintf("%s/buckets/%s/objects/%s/uploads/%s", host, bucket, key, uploadId)
-	return p.Conn.CallWithJson(ctx, &ret, "POST", url1, mp)
+	return p.callWithJson(ctx, &ret, "POST", url1, mp)
 }
 
 type CompletePartsRet struct {
@@ -119,7 +133,7 @@ func (p *CompleteMultipart) Sort() {
 //https://github.com/qbox/product/blob/master/kodo/resumable-up-v2/delete_parts.md
 func (p Uploader) deleteParts(ctx context.Context, host, bucket, key string, hasKey bool, uploadId string) error {
 	url1 := fmt.Sprintf("%s/buckets/%s/objects/%s/uploads/%s", host, bucket, encodeKey(key, hasKey), uploadId)
-	return p.Conn.Call(ctx, nil, "DELETE", url1)
+	return p.call(ctx, nil, "DELETE", url1)
 }
 
 func (p Uploader) Upload(ctx context.Context, ret interface{}, uptoken string, key string, f io.ReaderAt, fsize int64,
@@ -152,26 +166,42 @@ func (p Uploader) UploadWithoutKeyWithParts(ctx context.Context, ret interface{}
 
 func (p Uploader) upload(ctx context.Context, ret interface{}, uptoken, key string, hasKey bool, f io.ReaderAt, fsize int64, usePartSizeAsSuggested bool, uploadParts []int64,
 	mp *CompleteMultipart, partNotify func(partIdx int, etag string)) error {
+	_, err := p.uploadWithSession(ctx, ret, uptoken, key, hasKey, f, fsize, usePartSizeAsSuggested, uploadParts, mp, partNotify)
+	return err
+}
 
-	xl := xlog.FromContextSafe(ctx)
+func (p Uploader) uploadWithSession(ctx context.Context, ret interface{}, uptoken, key string, hasKey bool, f io.ReaderAt, fsize int64, usePartSizeAsSuggested bool, uploadParts []int64,
+	mp *CompleteMultipart, partNotify func(partIdx int, etag string)) (*UploadSession, error) {
+
+	ctx = withUptoken(ctx, uptoken)
+	session, concurrency, err := p.initSession(ctx, uptoken, key, hasKey, fsize, usePartSizeAsSuggested, uploadParts)
+	if err != nil {
+		return nil, err
+	}
+	return session, p.uploadSessionParts(ctx, ret, session, f, concurrency, mp, partNotify)
+}
+
+// 初始化分片上传，返回新的上传会话和上传分片的并发数，ctx 需要已经附加了上传凭证
+func (p Uploader) initSession(ctx context.Context, uptoken, key string, hasKey bool, fsize int64, usePartSizeAsSuggested bool, uploadParts []int64) (*UploadSession, int, error) {
 	if fsize == 0 {
-		return errors.New("can't upload empty file")
+		return nil, 0, errors.New("can't upload empty file")
 	}
 
 	policy, err := kodo.ParseUptoken(uptoken)
 	if err != nil {
-		return err
+		return nil, 0, err
 	}
 	bucket := strings.Split(policy.Scope, ":")[0]
 
-	p.Conn.Client = newUptokenClient(uptoken, p.Conn.Transport)
 	upHost := p.chooseUpHost(make(map[string]struct{}))
-	uploadId, suggestedPartSize, err := p.initParts(ctx, upHost, bucket, key, hasKey)
-	if err != nil {
+	uploadId, suggestedPartSize, expireAt, err := p.initParts(ctx, upHost, bucket, key, hasKey)
+	if err != nil && !resumableV2Unsupported(err) {
 		failHostName(upHost)
-		return err
-	} else {
-		succeedHostName(upHost)
+		return nil, 0, err
+	}
+	succeedHostName(upHost)
+	if err != nil {
+		return nil, 0, err
 	}
 
 	concurrency := p.Concurrency
@@ -180,23 +210,85 @@ func (p Uploader) upload(ctx context.Context, ret interface{}, uptoken, key stri
 		uploadParts = p.makeUploadPartsByPartSize(fsize, suggestedPartSize)
 	}
 
+	session := &UploadSession{
+		UploadId:  uploadId,
+		Bucket:    bucket,
+		Key:       key,
+		HasKey:    hasKey,
+		PartSizes: uploadParts,
+		ExpireAt:  expireAt,
+	}
+	return session, concurrency, nil
+}
+
+// 上传会话中还没有完成的分片，全部完成后合并分片
+func (p Uploader) uploadSessionParts(ctx context.Context, ret interface{}, session *UploadSession, f io.ReaderAt, concurrency int,
+	mp *CompleteMultipart, partNotify func(partIdx int, etag string)) error {
+
+	bucket, key, hasKey, uploadId := session.Bucket, session.Key, session.HasKey, session.UploadId
+	calcEtag := p.VerifyEtag && etagCompatible(session.PartSizes)
+
+	var (
+		etag      string
+		partUpErr error
+	)
+	if p.ReadAhead > 0 {
+		etag, partUpErr = p.uploadPartsPipelined(ctx, session, f, concurrency, calcEtag, partNotify)
+	} else {
+		etag, partUpErr = p.uploadPartsConcurrently(ctx, session, f, concurrency, calcEtag, partNotify)
+	}
+
+	if partUpErr != nil {
+		if p.KeepSessionOnFailure {
+			return partUpErr
+		}
+		if err := p.deletePartsWithRetry(ctx, bucket, key, hasKey, uploadId); err != nil {
+			return err
+		}
+		return partUpErr
+	}
+
+	if mp == nil {
+		mp = &CompleteMultipart{}
+	}
+	mp.Parts = session.completedParts()
+	if !calcEtag {
+		return p.completePartsWithRetry(ctx, ret, bucket, key, hasKey, uploadId, mp)
+	}
+	return p.completePartsAndVerifyEtag(ctx, ret, bucket, key, hasKey, uploadId, mp, etag)
+}
+
+// 每个分片在各自的 goroutine 中读取并上传，同时上传的分片数不超过 concurrency。
+// calcEtag 为 true 时在上传的同时计算每个分片中各块的 SHA1，最后合并为整个文件的 etag，
+// 会话中已经上传的分片只读取用于计算 etag，不会重新上传。
+func (p Uploader) uploadPartsConcurrently(ctx context.Context, session *UploadSession, f io.ReaderAt, concurrency int, calcEtag bool,
+	partNotify func(partIdx int, etag string)) (string, error) {
+
+	xl := xlog.FromContextSafe(ctx)
+	bucket, key, hasKey, uploadId := session.Bucket, session.Key, session.HasKey, session.UploadId
+
 	var partUpErr error
 	partUpErrLock := sync.Mutex{}
-	partCnt := len(uploadParts)
-	parts := make([]Part, partCnt)
 	partUpCtx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
 	var bkLimit = limit.NewBlockingCount(concurrency)
 	var wg sync.WaitGroup
 	var lastPartEnd int64 = 0
-	for i := 0; i < partCnt; i++ {
-		wg.Add(1)
-		bkLimit.Acquire(nil)
-		partSize := uploadParts[i]
+	var partSums [][]byte
+	if calcEtag {
+		partSums = make([][]byte, len(session.PartSizes))
+	}
+	for i, partSize := range session.PartSizes {
 		offset := lastPartEnd
 		lastPartEnd = partSize + offset
-		go func(f io.ReaderAt, offset int64, partNum int, partSize int64) {
+		uploaded := session.hasPart(i + 1)
+		if uploaded && !calcEtag {
+			continue
+		}
+		wg.Add(1)
+		bkLimit.Acquire(nil)
+		go func(f io.ReaderAt, offset int64, partNum int, partSize int64, uploaded bool) {
 			defer func() {
 				bkLimit.Release(nil)
 				wg.Done()
@@ -207,8 +299,22 @@ func (p Uploader) upload(ctx context.Context, ret interface{}, uptoken, key stri
 			default:
 			}
 
+			if uploaded {
+				etagHasher := NewEtagHasher()
+				if _, err := io.Copy(etagHasher, io.NewSectionReader(f, offset, partSize)); err != nil {
+					partUpErrLock.Lock()
+					partUpErr = err
+					partUpErrLock.Unlock()
+					cancel()
+					return
+				}
+				partSums[partNum-1] = etagHasher.blockSums()
+				return
+			}
+
 			var buf []byte = nil
 			if p.UseBuffer {
+				var err error
 				buf, err = ioutil.ReadAll(io.NewSectionReader(f, offset, partSize))
 				if err != nil {
 					partUpErrLock.Lock()
@@ -220,14 +326,23 @@ func (p Uploader) upload(ctx context.Context, ret interface{}, uptoken, key stri
 				}
 			}
 
+			// 每次尝试都重新计算，只保留最后一次成功上传时读取的数据的结果
+			var etagHasher *EtagHasher
 			getBody := func() (io.Reader, int) {
+				var body io.Reader
+				var bodyLen int
 				if buf == nil {
-					return io.NewSectionReader(f, offset, partSize), int(partSize)
+					body, bodyLen = io.NewSectionReader(f, offset, partSize), int(partSize)
 				} else {
-					return bytes.NewReader(buf), len(buf)
+					body, bodyLen = bytes.NewReader(buf), len(buf)
+				}
+				if calcEtag {
+					etagHasher = NewEtagHasher()
+					body = io.TeeReader(body, etagHasher)
 				}
+				return body, bodyLen
 			}
-			ret, err := p.uploadPartWithRetry(partUpCtx, bucket, key, hasKey, uploadId, partNum, getBody)
+			ret, err := p.uploadPartWithRetry(partUpCtx, bucket, key, hasKey, uploadId, partNum, "", getBody)
 			if err != nil {
 				partUpErrLock.Lock()
 				partUpErr = err
@@ -236,27 +351,27 @@ func (p Uploader) upload(ctx context.Context, ret interface{}, uptoken, key stri
 				cancel()
 				return
 			}
-			parts[partNum-1] = Part{partNum, ret.Etag}
+			if calcEtag {
+				partSums[partNum-1] = etagHasher.blockSums()
+			}
+			session.addPart(partNum, ret)
 			if partNotify != nil {
 				partNotify(partNum, ret.Etag)
 			}
-		}(f, offset, i+1, partSize)
+		}(f, offset, i+1, partSize, uploaded)
 	}
 	wg.Wait()
-
-	if partUpErr != nil {
-		err = p.deletePartsWithRetry(ctx, bucket, key, hasKey, uploadId)
-		if err != nil {
-			return err
-		}
-		return partUpErr
+	if partUpErr == nil && ctx.Err() != nil {
+		partUpErr = ctx.Err()
 	}
-
-	if mp == nil {
-		mp = &CompleteMultipart{}
+	if partUpErr != nil || !calcEtag {
+		return "", partUpErr
+	}
+	var sums []byte
+	for _, partSum := range partSums {
+		sums = append(sums, partSum...)
 	}
-	mp.Parts = parts
-	return p.completePartsWithRetry(ctx, ret, bucket, key, hasKey, uploadId, mp)
+	return etagOfBlockSums(sums), nil
 }
 
 func (p Uploader) makeUploadParts(fsize int64) []int64 {
@@ -330,23 +445,32 @@ func (s *sectionReader) Read(p []byte) (n int, err error) {
 }
 
 func (p Uploader) StreamUpload(ctx context.Context, ret interface{}, uptoken, key string, reader io.Reader, partNotify func(partIdx int, etag string)) error {
-	return p.streamUpload(ctx, ret, uptoken, key, true, reader, partNotify)
+	return p.streamUpload(ctx, ret, uptoken, key, true, nil, reader, nil, partNotify)
+}
+
+// 和 StreamUpload 相同，mp 用于设置 MimeType、Metadata 和 CustomVars，其中的 Parts 会被忽略
+func (p Uploader) StreamUploadWithMultipart(ctx context.Context, ret interface{}, uptoken, key string, reader io.Reader,
+	mp *CompleteMultipart, partNotify func(partIdx int, etag string)) error {
+	return p.streamUpload(ctx, ret, uptoken, key, true, nil, reader, mp, partNotify)
 }
 
 func (p Uploader) StreamUploadWithoutKey(ctx context.Context, ret interface{}, uptoken string, reader io.Reader, partNotify func(partIdx int, etag string)) error {
-	return p.streamUpload(ctx, ret, uptoken, "", false, reader, partNotify)
+	return p.streamUpload(ctx, ret, uptoken, "", false, nil, reader, nil, partNotify)
 }
 
-func (p Uploader) streamUpload(ctx context.Context, ret interface{}, uptoken, key string, hasKey bool, reader io.Reader, partNotify func(partIdx int, etag string)) error {
+// head 为调用方已经从数据流中读出的开头部分，之后的数据从 reader 读取；
+// head 的底层数组作为缓冲池中的一个缓冲区复用，不会在 StreamMemoryLimit 之外额外占用内存
+func (p Uploader) streamUpload(ctx context.Context, ret interface{}, uptoken, key string, hasKey bool, head []byte, reader io.Reader,
+	mp *CompleteMultipart, partNotify func(partIdx int, etag string)) error {
 	policy, err := kodo.ParseUptoken(uptoken)
 	if err != nil {
 		return err
 	}
 	bucket := strings.Split(policy.Scope, ":")[0]
 
-	p.Conn.Client = newUptokenClient(uptoken, p.Conn.Transport)
+	ctx = withUptoken(ctx, uptoken)
 	upHost := p.chooseUpHost(map[string]struct{}{})
-	uploadId, suggestedPartSize, err := p.initParts(ctx, upHost, bucket, key, hasKey)
+	uploadId, suggestedPartSize, _, err := p.initParts(ctx, upHost, bucket, key, hasKey)
 	if err != nil {
 		failHostName(upHost)
 		return err
@@ -361,9 +485,26 @@ func (p Uploader) streamUpload(ctx context.Context, ret interface{}, uptoken, ke
 	if suggestedPartSize > 0 {
 		partSize, concurrency = p.adaptivePartSizeAndConcurrency(ctx, suggestedPartSize)
 	}
+	buffers := newPartBufferPool(partSize, p.streamBufferCount(partSize, concurrency))
+	if head != nil {
+		// 第一次取得的就是 head 的底层数组，下面从 head 复制到缓冲区时源和目标相同，不会覆盖未读的数据
+		<-buffers.free
+		buffers.free <- head
+	}
+	if concurrency > buffers.count {
+		concurrency = buffers.count
+	}
 
 	var parts []Part
 	var partsLock sync.Mutex
+	var partUpErr error
+	var partUpErrOnce sync.Once
+	fail := func(err error) {
+		partUpErrOnce.Do(func() {
+			partUpErr = err
+			cancel()
+		})
+	}
 
 	var wg sync.WaitGroup
 	type PartData struct {
@@ -371,7 +512,6 @@ func (p Uploader) streamUpload(ctx context.Context, ret interface{}, uptoken, ke
 		PartNumber int
 	}
 	partChan := make(chan PartData)
-	errorChan := make(chan error, concurrency)
 
 	for i := 0; i < concurrency; i++ {
 		wg.Add(1)
@@ -389,11 +529,11 @@ func (p Uploader) streamUpload(ctx context.Context, ret interface{}, uptoken, ke
 					getBody := func() (io.Reader, int) {
 						return bytes.NewReader(partData.Data), len(partData.Data)
 					}
-					ret, err := p.uploadPartWithRetry(partUpCtx, bucket, key, hasKey, uploadId, partData.PartNumber, getBody)
+					ret, err := p.uploadPartWithRetry(partUpCtx, bucket, key, hasKey, uploadId, partData.PartNumber, "", getBody)
+					buffers.put(partData.Data)
 					if err != nil {
-						if err != context.Canceled {
-							errorChan <- err
-							cancel()
+						if partUpCtx.Err() == nil {
+							fail(err)
 						}
 						return
 					}
@@ -408,35 +548,129 @@ func (p Uploader) streamUpload(ctx context.Context, ret interface{}, uptoken, ke
 		}()
 	}
 
+	var etagHasher *EtagHasher
+	if p.VerifyEtag && partSize%EtagBlockSize == 0 {
+		etagHasher = NewEtagHasher()
+		etagHasher.Write(head)
+		reader = io.TeeReader(reader, etagHasher)
+	}
+
+	// 读取循环：先从缓冲池取得缓冲区，缓冲区全部在使用中时等待，分片上传失败或 ctx 取消时立即退出
+readLoop:
 	for partNum := 1; ; partNum++ {
-		data, err := ioutil.ReadAll(io.LimitReader(reader, partSize))
-		if err != nil {
-			close(partChan)
-			return err
-		} else if len(data) == 0 {
+		buf, ok := buffers.get(partUpCtx)
+		if !ok {
+			break
+		}
+		n := copy(buf, head)
+		if head = head[n:]; len(head) == 0 {
+			head = nil
+		}
+		var err error
+		if n < len(buf) {
+			var read int
+			read, err = io.ReadFull(reader, buf[n:])
+			n += read
+		}
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			buffers.put(buf)
+			fail(err)
+			break
+		} else if n == 0 {
+			buffers.put(buf)
+			break
+		}
+		if p.OnStreamPartRead != nil {
+			p.OnStreamPartRead(partNum, int64(n))
+		}
+		select {
+		case partChan <- PartData{Data: buf[:n], PartNumber: partNum}:
+		case <-partUpCtx.Done():
+			buffers.put(buf)
+			break readLoop
+		}
+		if n < len(buf) {
 			break
-		} else {
-			partChan <- PartData{Data: data, PartNumber: partNum}
 		}
 	}
 	close(partChan)
 	wg.Wait()
-	close(errorChan)
-	partUpErr := <-errorChan
+
+	if partUpErr == nil && ctx.Err() != nil {
+		partUpErr = ctx.Err()
+	}
+	if partUpErr == nil && len(parts) == 0 {
+		partUpErr = ErrEmptyStream
+	}
 	if partUpErr != nil {
-		err = p.deletePartsWithRetry(ctx, bucket, key, hasKey, uploadId)
+		err = p.deletePartsWithRetry(detachUptoken(ctx), bucket, key, hasKey, uploadId)
 		if err != nil {
 			return err
 		}
 		return partUpErr
 	}
-	completeMultipart := CompleteMultipart{Parts: parts}
+	var completeMultipart CompleteMultipart
+	if mp != nil {
+		completeMultipart = *mp
+	}
+	completeMultipart.Parts = parts
 	completeMultipart.Sort()
 
-	return p.completePartsWithRetry(ctx, ret, bucket, key, hasKey, uploadId, &completeMultipart)
+	if etagHasher == nil {
+		return p.completePartsWithRetry(ctx, ret, bucket, key, hasKey, uploadId, &completeMultipart)
+	}
+	return p.completePartsAndVerifyEtag(ctx, ret, bucket, key, hasKey, uploadId, &completeMultipart, etagHasher.Etag())
+}
+
+// 流式上传可以同时缓存的分片数，由 StreamMemoryLimit 决定，至少为 1，未设置时等于并发数
+func (p Uploader) streamBufferCount(partSize int64, concurrency int) int {
+	count := concurrency
+	if p.StreamMemoryLimit > 0 {
+		count = int(p.StreamMemoryLimit / partSize)
+	}
+	if count < 1 {
+		count = 1
+	}
+	return count
+}
+
+// 分片缓冲池，限制同时存在的缓冲区数量，缓冲区在分片之间复用，按需分配
+type partBufferPool struct {
+	free     chan []byte
+	partSize int64
+	count    int
 }
 
-func (p Uploader) uploadPartWithRetry(ctx context.Context, bucket, key string, hasKey bool, uploadId string, partNum int, getBody func() (io.Reader, int)) (ret UploadPartRet, err error) {
+func newPartBufferPool(partSize int64, count int) *partBufferPool {
+	pool := &partBufferPool{free: make(chan []byte, count), partSize: partSize, count: count}
+	for i := 0; i < count; i++ {
+		pool.free <- nil
+	}
+	return pool
+}
+
+// 取得一个缓冲区，全部在使用中时等待，ctx 取消时返回 false
+func (pool *partBufferPool) get(ctx context.Context) ([]byte, bool) {
+	if ctx.Err() != nil {
+		return nil, false
+	}
+	select {
+	case buf := <-pool.free:
+		if int64(cap(buf)) < pool.partSize {
+			buf = make([]byte, pool.partSize)
+		}
+		return buf[:pool.partSize], true
+	case <-ctx.Done():
+		return nil, false
+	}
+}
+
+func (pool *partBufferPool) put(buf []byte) {
+	pool.free <- buf[:cap(buf)]
+}
+
+func (p Uploader) uploadPartWithRetry(ctx context.Context, bucket, key string, hasKey bool, uploadId string, partNum int, partMd5 string,
+	getBody func() (io.Reader, int)) (ret UploadPartRet, err error) {
 	xl := xlog.NewWith(xlog.FromContextSafe(ctx).ReqId() + "." + fmt.Sprint(partNum))
 	tryTimes := uploadPartRetryTimes
 	failedUpHosts := make(map[string]struct{})
@@ -444,7 +678,7 @@ func (p Uploader) uploadPartWithRetry(ctx context.Context, bucket, key string, h
 	for {
 		upHost := p.chooseUpHost(failedUpHosts)
 		bodyReader, bodySize := getBody()
-		ret, err = p.uploadPart(ctx, upHost, bucket, key, hasKey, uploadId, partNum, bodyReader, bodySize)
+		ret, err = p.uploadPart(ctx, upHost, bucket, key, hasKey, uploadId, partNum, bodyReader, bodySize, partMd5)
 		if err == nil {
 			succeedHostName(upHost)
 			break
@@ -456,12 +690,18 @@ func (p Uploader) uploadPartWithRetry(ctx context.Context, bucket, key string, h
 			if code == 509 { // 因为流量受限失败，不减少重试次数
 				failedUpHosts[upHost] = struct{}{}
 				failHostName(upHost)
+				p.notifyPartRetry(partNum, upHost, err)
 				elog.Warn(xl.ReqId(), "uploadPartRetryLater:", partNum, err)
 				time.Sleep(time.Second * time.Duration(rand.Intn(9)+1))
+			} else if tryTimes > 1 && code == 401 && uptokenRefreshable(ctx) { // 上传凭证已经失效，使用重新获取的凭证重试
+				tryTimes--
+				p.notifyPartRetry(partNum, upHost, err)
+				elog.Warn(xl.ReqId(), "uploadPartRetryWithNewUptoken:", partNum, err)
 			} else if tryTimes > 1 && (code == 406 || code/100 != 4) {
 				failedUpHosts[upHost] = struct{}{}
 				failHostName(upHost)
 				tryTimes--
+				p.notifyPartRetry(partNum, upHost, err)
 				elog.Warn(xl.ReqId(), "uploadPartRetry:", partNum, err)
 				time.Sleep(time.Second * 3)
 			} else {
@@ -473,6 +713,43 @@ func (p Uploader) uploadPartWithRetry(ctx context.Context, bucket, key string, h
 	return
 }
 
+func (p Uploader) withPartProgress(r io.Reader, partNum int, upHost string) io.Reader {
+	if p.OnPartProgress == nil {
+		return r
+	}
+	return &partProgressReader{reader: r, partNum: partNum, upHost: upHost, onProgress: p.OnPartProgress}
+}
+
+func (p Uploader) withRateLimit(ctx context.Context, r io.Reader) io.Reader {
+	if len(p.RateLimiters) == 0 {
+		return r
+	}
+	return limit.NewRateLimitedReader(ctx, r, p.RateLimiters...)
+}
+
+func (p Uploader) notifyPartRetry(partNum int, upHost string, err error) {
+	if p.OnPartRetry != nil {
+		p.OnPartRetry(partNum, upHost, err)
+	}
+}
+
+type partProgressReader struct {
+	reader     io.Reader
+	partNum    int
+	upHost     string
+	uploaded   int64
+	onProgress func(partNum int, upHost string, uploaded int64)
+}
+
+func (r *partProgressReader) Read(b []byte) (n int, err error) {
+	n, err = r.reader.Read(b)
+	if n > 0 {
+		r.uploaded += int64(n)
+		r.onProgress(r.partNum, r.upHost, r.uploaded)
+	}
+	return
+}
+
 func (p Uploader) completePartsWithRetry(ctx context.Context, ret interface{}, bucket, key string, hasKey bool, uploadId string, mp *CompleteMultipart) (err error) {
 	xl := xlog.FromContextSafe(ctx)
 	failedUpHosts := make(map[string]struct{})
@@ -486,7 +763,8 @@ func (p Uploader) completePartsWithRetry(ctx context.Context, ret interface{}, b
 		code := httputil.DetectCode(err)
 		if err == nil || code/100 == 4 || code == 612 || code == 614 || code == 579 {
 			succeedHostName(upHost)
-			if code == 612 || code == 614 {
+			// 重试时 612/614 说明之前的请求已经成功，首次请求返回 614 则是 insertOnly 模式下对象已经存在
+			if i > 0 && (code == 612 || code == 614) {
 				elog.Warn(xl.ReqId(), "completeParts:", err)
 				err = nil
 			}
@@ -501,6 +779,14 @@ func (p Uploader) completePartsWithRetry(ctx context.Context, ret interface{}, b
 	return
 }
 
+func (p Uploader) completePartsAndVerifyEtag(ctx context.Context, ret interface{}, bucket, key string, hasKey bool, uploadId string, mp *CompleteMultipart, etag string) error {
+	var raw json.RawMessage
+	if err := p.completePartsWithRetry(ctx, &raw, bucket, key, hasKey, uploadId, mp); err != nil {
+		return err
+	}
+	return decodeRetAndVerifyEtag(raw, ret, etag)
+}
+
 func (p Uploader) deletePartsWithRetry(ctx context.Context, bucket, key string, hasKey bool, uploadId string) (err error) {
 	xl := xlog.FromContextSafe(ctx)
 	failedUpHosts := make(map[string]struct{})
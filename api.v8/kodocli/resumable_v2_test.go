@@ -1,6 +1,7 @@
 package kodocli
 
 import (
+	"bytes"
 	"context"
 	"crypto/md5"
 	"fmt"
@@ -27,7 +28,7 @@ func TestBlockCount(t *testing.T) {
 		uploader.UploadPartSize + 1: 2,
 	}
 	for fsize, num := range partNumbers {
-		n1 := uploader.partNumber(int64(fsize))
+		n1 := uploader.partNumber(fsize, uploader.UploadPartSize)
 		if n1 != num {
 			t.Fatalf("partNumber failed, fsize: %d, expect part number: %d, but got: %d", fsize, num, n1)
 		}
@@ -151,9 +152,81 @@ func TestStreamUpload(t *testing.T) {
 
 	defer resp.Body.Close()
 	var ret PutRet
-	err = upCli.StreamUpload(context.TODO(), &ret, upToken, key, resp.Body, resp.ContentLength, nil, nil)
+	err = upCli.StreamUpload(context.TODO(), &ret, upToken, key, resp.Body, nil)
 	if err != nil {
 		t.Fatalf("up file err: %v", err)
 	}
 	t.Log(ret)
 }
+
+type infiniteReader struct{}
+
+func (infiniteReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 'x'
+	}
+	return len(p), nil
+}
+
+func TestStreamUploadBoundedMemory(t *testing.T) {
+	server := newFakeUpServer()
+	defer server.Close()
+
+	data := bytes.Repeat([]byte("0123456789abcdef"), 5*EtagBlockSize/16+100)
+	up := NewUploader(0, &UploadConfig{UpHosts: []string{server.URL}, UploadPartSize: EtagBlockSize, Concurrency: 4,
+		StreamMemoryLimit: 2*EtagBlockSize + 1, VerifyEtag: true})
+	if count := up.streamBufferCount(EtagBlockSize, 4); count != 2 {
+		t.Fatalf("unexpected buffer count: %d", count)
+	}
+	var readParts []int64
+	up.OnStreamPartRead = func(partNum int, size int64) {
+		readParts = append(readParts, size)
+	}
+	var ret CompletePartsRet
+	if err := up.StreamUpload(context.Background(), &ret, fakeUptoken("bucket"), "key", bytes.NewReader(data), nil); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(server.completed, data) {
+		t.Fatal("completed data is not equal")
+	}
+	if len(readParts) != 6 || readParts[5] != int64(len(data))-5*EtagBlockSize {
+		t.Fatalf("unexpected read parts: %v", readParts)
+	}
+}
+
+func TestStreamUploadAbortOnPartFailure(t *testing.T) {
+	server := newFakeUpServer()
+	defer server.Close()
+	server.failPart = func(partNum int) int {
+		if partNum == 3 {
+			return http.StatusBadRequest
+		}
+		return 0
+	}
+
+	up := NewUploader(0, &UploadConfig{UpHosts: []string{server.URL}, UploadPartSize: EtagBlockSize, Concurrency: 2})
+	done := make(chan error, 1)
+	go func() {
+		done <- up.StreamUpload(context.Background(), nil, fakeUptoken("bucket"), "key", infiniteReader{}, nil)
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("stream upload should fail")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("stream upload is not aborted")
+	}
+	if len(server.deleted) != 1 {
+		t.Fatal("upload should be deleted")
+	}
+}
+
+func TestStreamUploadEmpty(t *testing.T) {
+	server := newFakeUpServer()
+	defer server.Close()
+	up := NewUploader(0, &UploadConfig{UpHosts: []string{server.URL}})
+	if err := up.StreamUpload(context.Background(), nil, fakeUptoken("bucket"), "key", bytes.NewReader(nil), nil); err != ErrEmptyStream {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
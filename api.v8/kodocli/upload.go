@@ -4,6 +4,7 @@ import (
 	"bytes"
 	. "context"
 	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"hash"
 	"hash/crc32"
@@ -16,6 +17,7 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/qiniupd/qiniu-go-sdk/x/httputil.v1"
@@ -126,7 +128,7 @@ func (p Uploader) put(
 	failedUpHosts := make(map[string]struct{})
 
 lzRetry:
-	var data io.Reader = io.NewSectionReader(dataReaderAt, 0, size)
+	var data io.Reader = p.withRateLimit(ctx, io.NewSectionReader(dataReaderAt, 0, size))
 	if extra.OnProgress != nil {
 		data = &readerWithProgress{reader: data, fsize: size, onProgress: extra.OnProgress}
 	}
@@ -209,7 +211,7 @@ lzRetry:
 	if extra.Md5Trailer == nil {
 		req.ContentLength = bodyLen
 	}
-	resp, err := p.Conn.Do(ctx, req)
+	resp, err := p.do(ctx, req)
 	if err != nil {
 		if err == Canceled {
 			return
@@ -365,6 +367,8 @@ func (r crc32Reader) length() (length int64) {
 // fsize   是要上传的文件大小。
 // extra   是上传的一些可选项。详细见 PutExtra 结构的描述。
 //
+// 失败时和表单上传一样切换上传域名重试，每次重试都从头读取 data。
+//
 func (p Uploader) Put2(
 	ctx Context, ret interface{}, uptoken, key string, data io.ReaderAt, size int64, extra *PutExtra) error {
 
@@ -374,44 +378,231 @@ func (p Uploader) Put2(
 func (p Uploader) put2(ctx Context, ret interface{}, uptoken, key string, data io.ReaderAt, size int64,
 	extra *PutExtra) error {
 
-	upHost := p.chooseUpHost(make(map[string]struct{}))
-	url := upHost + "/put/" + strconv.FormatInt(size, 10)
+	var (
+		etag      string
+		crc32Hash = crc32.NewIEEE()
+		calcCrc   = extra != nil && extra.Crc32 == CalcAndCheckCrc
+	)
+	if p.VerifyEtag || calcCrc {
+		etagHasher := NewEtagHasher()
+		if _, err := io.Copy(io.MultiWriter(etagHasher, crc32Hash), io.NewSectionReader(data, 0, size)); err != nil {
+			return err
+		}
+		etag = etagHasher.Etag()
+	}
+
+	path := "/put/" + strconv.FormatInt(size, 10)
 	if extra != nil {
 		if extra.MimeType != "" {
-			url += "/mimeType/" + base64.URLEncoding.EncodeToString([]byte(extra.MimeType))
+			path += "/mimeType/" + base64.URLEncoding.EncodeToString([]byte(extra.MimeType))
 		}
-		if extra.Crc32 != DontCheckCrc {
-			url += "/crc32/" + strconv.FormatInt(int64(extra.Crc32), 10)
+		if calcCrc {
+			path += "/crc32/" + strconv.FormatInt(int64(crc32Hash.Sum32()), 10)
+		} else if extra.Crc32 != DontCheckCrc {
+			path += "/crc32/" + strconv.FormatInt(int64(extra.Crc32), 10)
 		}
 		for k, v := range extra.Params {
 			if strings.HasPrefix(k, "x:") && v != "" {
-				url += "/" + k + "/" + base64.URLEncoding.EncodeToString([]byte(v))
+				path += "/" + k + "/" + base64.URLEncoding.EncodeToString([]byte(v))
 			}
 		}
+		for k, v := range extra.XMeta {
+			path += "/x-qn-meta-" + k + "/" + base64.URLEncoding.EncodeToString([]byte(v))
+		}
 	}
-
 	if key != "" {
-		url += "/key/" + base64.URLEncoding.EncodeToString([]byte(key))
+		path += "/key/" + base64.URLEncoding.EncodeToString([]byte(key))
+	}
+
+	tryTimes := formUploadRetryTimes
+	xl := xlog.NewWith(xlog.FromContextSafe(ctx).ReqId())
+	failedUpHosts := make(map[string]struct{})
+	var err error
+
+	for {
+		upHost := p.chooseUpHost(failedUpHosts)
+		err = p.put2Once(ctx, ret, upHost, path, uptoken, data, size, extra, etag)
+		if err == nil {
+			succeedHostName(upHost)
+			break
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err == ErrEtagNotMatch {
+			return err
+		}
+		code := httputil.DetectCode(err)
+		if code == 509 {
+			failedUpHosts[upHost] = struct{}{}
+			failHostName(upHost)
+			elog.Warn(xl.ReqId(), "put2RetryLater:", err)
+			if err = sleepWithContext(ctx, time.Second*time.Duration(rand.Intn(9)+1)); err != nil {
+				return err
+			}
+			continue
+		} else if tryTimes > 1 && put2Retryable(code) {
+			failedUpHosts[upHost] = struct{}{}
+			failHostName(upHost)
+			tryTimes--
+			elog.Warn(xl.ReqId(), "put2Retry:", err)
+			if err = sleepWithContext(ctx, time.Second*3); err != nil {
+				return err
+			}
+			continue
+		}
+		if put2Retryable(code) {
+			failHostName(upHost)
+		} else {
+			succeedHostName(upHost)
+		}
+		return err
 	}
-	elog.Debug("Put2", url)
-	req, err := http.NewRequest("POST", url, io.NewSectionReader(data, 0, size))
+	if extra != nil && extra.OnProgress != nil {
+		extra.OnProgress(size, size)
+	}
+	return nil
+}
+
+// Put2 失败后是否换一个上传域名重试，只有 406、5xx 和网络错误可以重试。
+// 579（回调失败）和 612、614 等 6xx 错误是服务端明确的结果，重试也不会成功，域名本身也没有问题。
+func put2Retryable(code int) bool {
+	return code == 406 || code/100 == 5 && code != 579
+}
+
+// 发起一次 Put2 请求，每次都从头读取数据
+func (p Uploader) put2Once(ctx Context, ret interface{}, upHost, path, uptoken string, data io.ReaderAt, size int64,
+	extra *PutExtra, etag string) error {
+
+	var body io.Reader = p.withPartProgress(p.withRateLimit(ctx, io.NewSectionReader(data, 0, size)), 1, upHost)
+	if extra != nil && extra.OnProgress != nil {
+		body = &readerWithProgress{reader: body, fsize: size, onProgress: extra.OnProgress}
+	}
+	elog.Debug("Put2", upHost+path)
+	req, err := http.NewRequest("POST", upHost+path, body)
 	if err != nil {
-		failHostName(upHost)
 		return err
 	}
+	req = req.WithContext(ctx)
 	req.Header.Set("Content-Type", "application/octet-stream")
-	req.Header.Set("Authorization", "UpToken "+uptoken)
 	req.ContentLength = size
-	resp, err := p.Conn.Do(ctx, req)
+	resp, err := p.do(withUptoken(ctx, uptoken), req)
 	if err != nil {
-		failHostName(upHost)
 		return err
 	}
-	err = rpc.CallRet(ctx, ret, resp)
+	if !p.VerifyEtag {
+		return rpc.CallRet(ctx, ret, resp)
+	}
+	var raw json.RawMessage
+	if err = rpc.CallRet(ctx, &raw, resp); err != nil {
+		return err
+	}
+	return decodeRetAndVerifyEtag(raw, ret, etag)
+}
+
+// 等待 d 或 ctx 结束，ctx 结束时返回其错误
+func sleepWithContext(ctx Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// ----------------------------------------------------------
+
+// 上传一个大小未知的数据流。
+// 数据不超过一个分片大小（UploadPartSize）时使用 Put2 上传，包括空数据；否则使用分片上传 v2 流式上传。
+// extra 中的 MimeType、XMeta、Params 对两种方式都生效，OnProgress 会被串行调用，其 fsize 在数据读完之前为 -1。
+// Crc32 只对 Put2 生效。
+//
+func (p Uploader) PutReader(
+	ctx Context, ret interface{}, uptoken, key string, reader io.Reader, extra *PutExtra) error {
+
+	if extra == nil {
+		extra = &defaultPutExtra
+	}
+	firstPart, err := readAtMost(reader, p.UploadPartSize+1)
 	if err != nil {
-		failHostName(upHost)
 		return err
 	}
-	succeedHostName(upHost)
-	return nil
+	if n := int64(len(firstPart)); n <= p.UploadPartSize {
+		return p.Put2(ctx, ret, uptoken, key, bytes.NewReader(firstPart), n, extra)
+	}
+
+	mp := &CompleteMultipart{MimeType: extra.MimeType, Metadata: extra.XMeta}
+	for k, v := range extra.Params {
+		if strings.HasPrefix(k, "x:") {
+			if mp.CustomVars == nil {
+				mp.CustomVars = make(map[string]string)
+			}
+			mp.CustomVars[k] = v
+		}
+	}
+
+	var partNotify func(partIdx int, etag string)
+	if extra.OnProgress != nil {
+		var (
+			lock      sync.Mutex
+			partSizes = make(map[int]int64)
+			uploaded  int64
+			read      int64
+		)
+		onStreamPartRead := p.OnStreamPartRead
+		p.OnStreamPartRead = func(partNum int, size int64) {
+			if onStreamPartRead != nil {
+				onStreamPartRead(partNum, size)
+			}
+			lock.Lock()
+			partSizes[partNum] = size
+			read += size
+			lock.Unlock()
+		}
+		partNotify = func(partIdx int, etag string) {
+			lock.Lock()
+			defer lock.Unlock()
+			uploaded += partSizes[partIdx]
+			extra.OnProgress(-1, uploaded)
+		}
+		defer func() {
+			if err == nil {
+				lock.Lock()
+				extra.OnProgress(read, read)
+				lock.Unlock()
+			}
+		}()
+	}
+	err = p.streamUpload(ctx, ret, uptoken, key, true, firstPart, reader, mp, partNotify)
+	return err
+}
+
+// 读取数据流开头的最多 limit 个字节，缓冲区随读取的数据增长，数据较少时不会分配 limit 大小的内存
+func readAtMost(reader io.Reader, limit int64) ([]byte, error) {
+	const initialSize = 64 * 1024
+
+	size := limit
+	if size > initialSize {
+		size = initialSize
+	}
+	buf := make([]byte, 0, size)
+	for int64(len(buf)) < limit {
+		if len(buf) == cap(buf) {
+			size = 2 * int64(cap(buf))
+			if size > limit {
+				size = limit
+			}
+			buf = append(make([]byte, 0, size), buf...)
+		}
+		n, err := reader.Read(buf[len(buf):cap(buf)])
+		buf = buf[:len(buf)+n]
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	return buf, nil
 }
@@ -0,0 +1,154 @@
+package kodocli
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/qiniupd/qiniu-go-sdk/x/rpc.v7"
+)
+
+// 上传使用的协议
+type UploadProtocol string
+
+const (
+	ProtocolForm        UploadProtocol = "form"         // 表单上传
+	ProtocolResumableV1 UploadProtocol = "resumable_v1" // 分片上传 v1（mkblk/bput/mkfile）
+	ProtocolResumableV2 UploadProtocol = "resumable_v2" // 分片上传 v2（/buckets/.../uploads）
+)
+
+// 已知不支持分片上传 v2 的上传域名列表及记录的过期时间，过期前直接使用分片上传 v1
+var resumableV2UnsupportedHosts sync.Map
+
+// 不支持分片上传 v2 的记录的有效期，过期后重新尝试 v2，服务端升级后可以自动用上
+const resumableV2UnsupportedTTL = 30 * time.Minute
+
+// 服务端不支持某个接口时错误信息中包含的内容
+var unsupportedApiErrors = []string{"method not allowed", "not supported", "unsupported", "not implemented", "no such api", "unknown api"}
+
+// 上传一个本地文件，自动选择上传协议，返回实际使用的协议。
+// 文件不超过一个分片大小（UploadPartSize）时使用表单上传，否则使用分片上传 v2；
+// 如果服务端初始化分片上传 v2 时返回 404 或 405，并且错误信息表明不支持该接口，则改用分片上传 v1，
+// 并在一段时间内记住这组上传域名不支持 v2。
+// extra 中的 MimeType、XMeta、Params、OnProgress 对所有协议都生效，Crc32 和 Md5Trailer 只对表单上传生效。
+func (p Uploader) UploadFile(
+	ctx context.Context, ret interface{}, uptoken, key, localFile string, extra *PutExtra) (UploadProtocol, error) {
+
+	f, err := os.Open(localFile)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	return p.uploadAuto(ctx, ret, uptoken, key, f, fi.Size(), extra, filepath.Base(localFile))
+}
+
+func (p Uploader) uploadAuto(ctx context.Context, ret interface{}, uptoken, key string, f io.ReaderAt, fsize int64,
+	extra *PutExtra, fileName string) (UploadProtocol, error) {
+
+	if extra == nil {
+		extra = &defaultPutExtra
+	}
+	if fsize <= p.UploadPartSize {
+		return ProtocolForm, p.put(ctx, ret, uptoken, key, true, f, fsize, extra, fileName)
+	}
+
+	hostsKey := strings.Join(p.UpHosts, ",")
+	if !resumableV2KnownUnsupported(hostsKey) {
+		ctx = withUptoken(ctx, uptoken)
+		session, concurrency, err := p.initSession(ctx, uptoken, key, true, fsize, true, p.makeUploadParts(fsize))
+		if err == nil {
+			return ProtocolResumableV2, p.uploadAutoV2(ctx, ret, session, concurrency, f, fsize, extra)
+		} else if !resumableV2Unsupported(err) {
+			return ProtocolResumableV2, err
+		}
+		elog.Warn("resumable v2 is not supported by", hostsKey, ", fallback to v1:", err)
+		resumableV2UnsupportedHosts.Store(hostsKey, time.Now().Add(resumableV2UnsupportedTTL))
+	}
+	return ProtocolResumableV1, p.uploadAutoV1(ctx, ret, uptoken, key, f, fsize, extra)
+}
+
+func (p Uploader) uploadAutoV2(ctx context.Context, ret interface{}, session *UploadSession, concurrency int, f io.ReaderAt, fsize int64,
+	extra *PutExtra) error {
+
+	mp := &CompleteMultipart{MimeType: extra.MimeType, Metadata: extra.XMeta}
+	for k, v := range extra.Params {
+		if strings.HasPrefix(k, "x:") {
+			if mp.CustomVars == nil {
+				mp.CustomVars = make(map[string]string)
+			}
+			mp.CustomVars[k] = v
+		}
+	}
+
+	var partNotify func(partIdx int, etag string)
+	if extra.OnProgress != nil {
+		var (
+			lock     sync.Mutex
+			uploaded int64
+		)
+		partNotify = func(partIdx int, etag string) {
+			lock.Lock()
+			defer lock.Unlock()
+			uploaded += session.PartSizes[partIdx-1]
+			extra.OnProgress(fsize, uploaded)
+		}
+	}
+	return p.uploadSessionParts(ctx, ret, session, f, concurrency, mp, partNotify)
+}
+
+func (p Uploader) uploadAutoV1(ctx context.Context, ret interface{}, uptoken, key string, f io.ReaderAt, fsize int64, extra *PutExtra) error {
+	rputExtra := &RputExtra{Params: extra.Params, XMeta: extra.XMeta, MimeType: extra.MimeType}
+	if extra.OnProgress != nil {
+		var (
+			lock     sync.Mutex
+			offsets  = make(map[int]int64)
+			uploaded int64
+		)
+		rputExtra.Notify = func(blkIdx int, blkSize int, ret *BlkputRet) {
+			lock.Lock()
+			defer lock.Unlock()
+			uploaded += int64(ret.Offset) - offsets[blkIdx]
+			offsets[blkIdx] = int64(ret.Offset)
+			extra.OnProgress(fsize, uploaded)
+		}
+	}
+	return p.rput(ctx, ret, uptoken, key, true, f, fsize, rputExtra)
+}
+
+// 这组上传域名是否在有效期内被记录为不支持分片上传 v2
+func resumableV2KnownUnsupported(hostsKey string) bool {
+	expireAt, ok := resumableV2UnsupportedHosts.Load(hostsKey)
+	if !ok {
+		return false
+	}
+	if time.Now().Before(expireAt.(time.Time)) {
+		return true
+	}
+	resumableV2UnsupportedHosts.Delete(hostsKey)
+	return false
+}
+
+// 初始化分片上传 v2 时服务端返回 404 或 405，并且错误信息表明不支持该接口，说明不支持该协议；
+// 只有状态码没有错误信息时可能是其他原因（例如网关或空间配置），不能据此判断
+func resumableV2Unsupported(err error) bool {
+	ei, ok := err.(*rpc.ErrorInfo)
+	if !ok || ei.Code != 404 && ei.Code != 405 {
+		return false
+	}
+	msg := strings.ToLower(ei.Err)
+	for _, unsupported := range unsupportedApiErrors {
+		if strings.Contains(msg, unsupported) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,102 @@
+package kodocli
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/qiniupd/qiniu-go-sdk/x/rpc.v7"
+)
+
+func TestUploadFileProtocol(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kodocli")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	small := bytes.Repeat([]byte("x"), 100)
+	large := bytes.Repeat([]byte("0123456789abcdef"), 2*EtagBlockSize/16+100)
+	smallFile, largeFile := filepath.Join(dir, "small"), filepath.Join(dir, "large")
+	ioutil.WriteFile(smallFile, small, 0644)
+	ioutil.WriteFile(largeFile, large, 0644)
+
+	server := newFakeUpServer()
+	defer server.Close()
+	up := NewUploader(0, &UploadConfig{UpHosts: []string{server.URL}, UploadPartSize: EtagBlockSize})
+
+	cases := []struct {
+		file     string
+		data     []byte
+		noV2     bool
+		protocol UploadProtocol
+	}{
+		{largeFile, large, false, ProtocolResumableV2},
+		{largeFile, large, true, ProtocolResumableV1},
+		{largeFile, large, false, ProtocolResumableV1},
+	}
+	for i, c := range cases {
+		server.noV2 = c.noV2
+		server.completed = nil
+		var uploaded int64
+		extra := PutExtra{OnProgress: func(fsize, n int64) { uploaded = n }}
+		protocol, err := up.UploadFile(context.Background(), nil, fakeUptoken("bucket"), "key", c.file, &extra)
+		if err != nil {
+			t.Fatal(i, err)
+		}
+		if protocol != c.protocol {
+			t.Fatalf("case %d: unexpected protocol %s", i, protocol)
+		}
+		if !bytes.Equal(server.completed, c.data) {
+			t.Fatalf("case %d: completed data is not equal", i)
+		}
+		if uploaded != int64(len(c.data)) {
+			t.Fatalf("case %d: unexpected progress %d", i, uploaded)
+		}
+	}
+
+	// 记录过期后重新尝试分片上传 v2
+	resumableV2UnsupportedHosts.Store(server.URL, time.Now().Add(-time.Second))
+	protocol, err := up.UploadFile(context.Background(), nil, fakeUptoken("bucket"), "key", largeFile, nil)
+	if err != nil || protocol != ProtocolResumableV2 {
+		t.Fatalf("unexpected result: %s %v", protocol, err)
+	}
+
+	var ret PutRet
+	protocol, err = up.UploadFile(context.Background(), &ret, fakeUptoken("bucket"), "key", smallFile, nil)
+	if err != nil || protocol != ProtocolForm {
+		t.Fatalf("unexpected result: %s %v", protocol, err)
+	}
+	if !bytes.Equal(server.completed, small) {
+		t.Fatal("completed data is not equal")
+	}
+	if etag, _ := GetEtag(bytes.NewReader(small)); ret.Hash != etag {
+		t.Fatalf("unexpected hash: %s", ret.Hash)
+	}
+}
+
+func TestResumableV2Unsupported(t *testing.T) {
+	cases := []struct {
+		err         error
+		unsupported bool
+	}{
+		{&rpc.ErrorInfo{Code: 405, Err: "method not allowed"}, true},
+		{&rpc.ErrorInfo{Code: 404, Err: "API is not supported"}, true},
+		{&rpc.ErrorInfo{Code: 404}, false},
+		{&rpc.ErrorInfo{Code: 405}, false},
+		{&rpc.ErrorInfo{Code: 404, Err: "no such bucket"}, false},
+		{&rpc.ErrorInfo{Code: 400, Err: "not supported"}, false},
+		{errors.New("method not allowed"), false},
+		{nil, false},
+	}
+	for i, c := range cases {
+		if resumableV2Unsupported(c.err) != c.unsupported {
+			t.Fatalf("case %d: unexpected result for %v", i, c.err)
+		}
+	}
+}
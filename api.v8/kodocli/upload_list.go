@@ -0,0 +1,209 @@
+package kodocli
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/qiniupd/qiniu-go-sdk/api.v8/kodo"
+	"github.com/qiniupd/qiniu-go-sdk/x/httputil.v1"
+	"github.com/qiniupd/qiniu-go-sdk/x/xlog.v8"
+)
+
+const listRetryTimes = 5
+const listPartsLimit = 1000
+const listUploadsLimit = 1000
+
+// 服务端记录的已上传分片
+type ListedPart struct {
+	PartNumber int    `json:"partNumber"`
+	Etag       string `json:"etag"`
+	Size       int64  `json:"size"`
+	PutTime    int64  `json:"putTime"`
+}
+
+type listPartsRet struct {
+	UploadId         string       `json:"uploadId"`
+	ExpireAt         int64        `json:"expireAt"`
+	PartNumberMarker int          `json:"partNumberMarker"`
+	Parts            []ListedPart `json:"parts"`
+}
+
+// 进行中的分片上传
+type MultipartUpload struct {
+	Key      string `json:"key"`
+	UploadId string `json:"uploadId"`
+	// 创建时间（Unix 时间戳，单位为秒）
+	CreatedAt int64 `json:"createdAt"`
+	ExpireAt  int64 `json:"expireAt"`
+}
+
+type listUploadsRet struct {
+	Marker  string            `json:"marker"`
+	Uploads []MultipartUpload `json:"uploads"`
+}
+
+// 列举分片上传中服务端已经收到的分片，自动处理分页，结果按分片号排序
+func (p Uploader) ListParts(ctx context.Context, uptoken, key, uploadId string) ([]ListedPart, error) {
+	bucket, err := bucketOfUptoken(uptoken)
+	if err != nil {
+		return nil, err
+	}
+	ctx = withUptoken(ctx, uptoken)
+	return p.listParts(ctx, bucket, key, true, uploadId)
+}
+
+func (p Uploader) listParts(ctx context.Context, bucket, key string, hasKey bool, uploadId string) (parts []ListedPart, err error) {
+	marker := 0
+	for {
+		var ret listPartsRet
+		err = p.callWithRetry(ctx, "listParts", func(host string) error {
+			url1 := fmt.Sprintf("%s/buckets/%s/objects/%s/uploads/%s?max-parts=%d", host, bucket, encodeKey(key, hasKey), uploadId, listPartsLimit)
+			if marker > 0 {
+				url1 += "&part-number-marker=" + strconv.Itoa(marker)
+			}
+			return p.call(ctx, &ret, "GET", url1)
+		})
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, ret.Parts...)
+		if ret.PartNumberMarker <= marker || len(ret.Parts) == 0 {
+			return parts, nil
+		}
+		marker = ret.PartNumberMarker
+	}
+}
+
+// 列举存储空间中指定前缀下进行中的分片上传，自动处理分页
+func (p Uploader) ListMultipartUploads(ctx context.Context, uptoken, prefix string) (uploads []MultipartUpload, err error) {
+	bucket, err := bucketOfUptoken(uptoken)
+	if err != nil {
+		return nil, err
+	}
+	ctx = withUptoken(ctx, uptoken)
+
+	marker := ""
+	for {
+		var ret listUploadsRet
+		err = p.callWithRetry(ctx, "listMultipartUploads", func(host string) error {
+			query := url.Values{"limit": {strconv.Itoa(listUploadsLimit)}}
+			if prefix != "" {
+				query.Set("prefix", prefix)
+			}
+			if marker != "" {
+				query.Set("marker", marker)
+			}
+			return p.call(ctx, &ret, "GET", fmt.Sprintf("%s/buckets/%s/uploads?%s", host, bucket, query.Encode()))
+		})
+		if err != nil {
+			return nil, err
+		}
+		uploads = append(uploads, ret.Uploads...)
+		if ret.Marker == "" || ret.Marker == marker {
+			return uploads, nil
+		}
+		marker = ret.Marker
+	}
+}
+
+// 终止指定前缀下创建时间早于 olderThan 之前的分片上传，返回已经终止的上传
+// 服务端没有返回创建时间的上传无法判断是否过期，不会被终止；单个上传终止失败不会中断，返回第一个错误
+func (p Uploader) AbortStaleUploads(ctx context.Context, uptoken, prefix string, olderThan time.Duration) ([]MultipartUpload, error) {
+	bucket, err := bucketOfUptoken(uptoken)
+	if err != nil {
+		return nil, err
+	}
+	uploads, err := p.ListMultipartUploads(ctx, uptoken, prefix)
+	if err != nil {
+		return nil, err
+	}
+	ctx = withUptoken(ctx, uptoken)
+
+	var (
+		aborted  []MultipartUpload
+		firstErr error
+		deadline = time.Now().Add(-olderThan).Unix()
+	)
+	for _, upload := range uploads {
+		if upload.CreatedAt == 0 || upload.CreatedAt >= deadline {
+			continue
+		}
+		if err = p.deletePartsWithRetry(ctx, bucket, upload.Key, true, upload.UploadId); err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		aborted = append(aborted, upload)
+	}
+	return aborted, firstErr
+}
+
+// 以服务端记录的分片为准更新会话，用于继续上传前核对本地保存的状态
+func (p Uploader) RefreshSession(ctx context.Context, uptoken string, session *UploadSession) error {
+	if session == nil || session.UploadId == "" {
+		return ErrInvalidSession
+	}
+	ctx = withUptoken(ctx, uptoken)
+	listedParts, err := p.listParts(ctx, session.Bucket, session.Key, session.HasKey, session.UploadId)
+	if err != nil {
+		return err
+	}
+
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	md5s := make(map[int]string, len(session.Parts))
+	for _, part := range session.Parts {
+		md5s[part.PartNumber] = part.Md5
+	}
+	parts := make([]UploadedPart, 0, len(listedParts))
+	for _, part := range listedParts {
+		// 大小与会话不一致的分片不可用，需要重新上传
+		if part.PartNumber < 1 || part.PartNumber > len(session.PartSizes) || part.Size != session.PartSizes[part.PartNumber-1] {
+			continue
+		}
+		parts = append(parts, UploadedPart{PartNumber: part.PartNumber, Etag: part.Etag, Md5: md5s[part.PartNumber]})
+	}
+	session.Parts = parts
+	return nil
+}
+
+func (p Uploader) callWithRetry(ctx context.Context, name string, call func(host string) error) (err error) {
+	xl := xlog.FromContextSafe(ctx)
+	failedUpHosts := make(map[string]struct{})
+
+	for i := 0; i < listRetryTimes; i++ {
+		upHost := p.chooseUpHost(failedUpHosts)
+		err = call(upHost)
+		if err != nil && ctx.Err() != nil {
+			return ctx.Err()
+		}
+		code := httputil.DetectCode(err)
+		if err == nil || code/100 == 4 || code == 612 {
+			succeedHostName(upHost)
+			break
+		}
+		failedUpHosts[upHost] = struct{}{}
+		failHostName(upHost)
+		elog.Warn(xl.ReqId(), name+":", err)
+		if i == listRetryTimes-1 {
+			break
+		}
+		if err = sleepWithContext(ctx, time.Second*3); err != nil {
+			return err
+		}
+	}
+	return
+}
+
+func bucketOfUptoken(uptoken string) (string, error) {
+	policy, err := kodo.ParseUptoken(uptoken)
+	if err != nil {
+		return "", err
+	}
+	return strings.Split(policy.Scope, ":")[0], nil
+}
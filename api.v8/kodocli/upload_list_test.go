@@ -0,0 +1,94 @@
+package kodocli
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestListParts(t *testing.T) {
+	server := newFakeUpServer()
+	defer server.Close()
+	for partNum := 1; partNum <= listPartsLimit+5; partNum++ {
+		if partNum != 3 {
+			server.parts[partNum] = []byte("data")
+		}
+	}
+	server.parts[4] = []byte("short")
+
+	up := NewUploader(0, &UploadConfig{UpHosts: []string{server.URL}})
+	parts, err := up.ListParts(context.Background(), fakeUptoken("bucket"), "key", "upload-id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parts) != listPartsLimit+4 || parts[0].PartNumber != 1 || parts[2].PartNumber != 4 || parts[len(parts)-1].PartNumber != listPartsLimit+5 {
+		t.Fatalf("unexpected parts: %d", len(parts))
+	}
+
+	session := UploadSession{UploadId: "upload-id", Bucket: "bucket", Key: "key", HasKey: true, PartSizes: []int64{4, 4, 4, 4, 4},
+		Parts: []UploadedPart{{PartNumber: 1, Etag: "etag-1", Md5: "md5-1"}, {PartNumber: 3, Etag: "etag-3"}}}
+	if err = up.RefreshSession(context.Background(), fakeUptoken("bucket"), &session); err != nil {
+		t.Fatal(err)
+	}
+	// 分片 3 服务端不存在，分片 4 大小不一致，分片 6 之后超出会话范围
+	expected := []UploadedPart{{1, "etag-1", "md5-1"}, {2, "etag-2", ""}, {5, "etag-5", ""}}
+	if len(session.Parts) != len(expected) {
+		t.Fatalf("unexpected session parts: %+v", session.Parts)
+	}
+	for i, part := range expected {
+		if session.Parts[i] != part {
+			t.Fatalf("unexpected session part: %+v", session.Parts[i])
+		}
+	}
+}
+
+func TestAbortStaleUploads(t *testing.T) {
+	server := newFakeUpServer()
+	defer server.Close()
+	now := time.Now()
+	server.uploads = []MultipartUpload{
+		{Key: "old", UploadId: "old-id", CreatedAt: now.Add(-48 * time.Hour).Unix()},
+		{Key: "new", UploadId: "new-id", CreatedAt: now.Add(-time.Hour).Unix()},
+		{Key: "unknown", UploadId: "unknown-id"},
+	}
+
+	up := NewUploader(0, &UploadConfig{UpHosts: []string{server.URL}})
+	uploads, err := up.ListMultipartUploads(context.Background(), fakeUptoken("bucket"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(uploads) != 3 {
+		t.Fatalf("unexpected uploads: %+v", uploads)
+	}
+
+	aborted, err := up.AbortStaleUploads(context.Background(), fakeUptoken("bucket"), "", 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(aborted) != 1 || aborted[0].UploadId != "old-id" {
+		t.Fatalf("unexpected aborted uploads: %+v", aborted)
+	}
+	if len(server.deleted) != 1 || server.deleted[0] != "old-id" {
+		t.Fatalf("unexpected deleted uploads: %v", server.deleted)
+	}
+}
+
+func TestCallWithRetryContext(t *testing.T) {
+	up := NewUploader(0, &UploadConfig{UpHosts: []string{"http://up1"}})
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	calls := 0
+	start := time.Now()
+	err := up.callWithRetry(ctx, "test", func(host string) error {
+		calls++
+		return errors.New("failed")
+	})
+	if err != context.DeadlineExceeded || calls != 1 {
+		t.Fatalf("unexpected result: %v, %d calls", err, calls)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("retry wait is not interrupted by ctx: %v", elapsed)
+	}
+}
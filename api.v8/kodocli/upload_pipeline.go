@@ -0,0 +1,156 @@
+package kodocli
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"io"
+	"sync"
+
+	"github.com/qiniupd/qiniu-go-sdk/x/xlog.v8"
+)
+
+// 预读的分片
+type readAheadPart struct {
+	data    []byte
+	partNum int
+	md5     string
+	// 会话中已经上传的分片，只用于计算 etag
+	uploaded bool
+}
+
+// 按顺序预读分片到缓冲区，读取、计算 MD5 和 etag、上传分别在不同的 goroutine 中进行，最多预读 ReadAhead 个分片。
+// calcEtag 为 true 时在同一次读取中计算整个文件的 etag，这时会话中已经上传的分片也需要读取，但不会重新上传。
+func (p Uploader) uploadPartsPipelined(ctx context.Context, session *UploadSession, f io.ReaderAt, concurrency int, calcEtag bool,
+	partNotify func(partIdx int, etag string)) (string, error) {
+
+	xl := xlog.FromContextSafe(ctx)
+	bucket, key, hasKey, uploadId := session.Bucket, session.Key, session.HasKey, session.UploadId
+
+	partUpCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var partUpErr error
+	var partUpErrOnce sync.Once
+	fail := func(err error) {
+		partUpErrOnce.Do(func() {
+			partUpErr = err
+			cancel()
+		})
+	}
+
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	var maxPartSize int64
+	for _, partSize := range session.PartSizes {
+		if partSize > maxPartSize {
+			maxPartSize = partSize
+		}
+	}
+	buffers := newPartBufferPool(maxPartSize, concurrency+p.ReadAhead)
+	readChan := make(chan readAheadPart, p.ReadAhead)
+	hashedChan := make(chan readAheadPart)
+
+	var stages sync.WaitGroup
+	stages.Add(2)
+
+	// 读取：按顺序读取分片，缓冲区全部在使用中时等待
+	go func() {
+		defer stages.Done()
+		defer close(readChan)
+		var offset int64
+		for i, partSize := range session.PartSizes {
+			partOffset := offset
+			offset += partSize
+			uploaded := session.hasPart(i + 1)
+			if uploaded && !calcEtag {
+				continue
+			}
+			buf, ok := buffers.get(partUpCtx)
+			if !ok {
+				return
+			}
+			buf = buf[:partSize]
+			if _, err := io.ReadFull(io.NewSectionReader(f, partOffset, partSize), buf); err != nil {
+				buffers.put(buf)
+				fail(err)
+				return
+			}
+			select {
+			case readChan <- readAheadPart{data: buf, partNum: i + 1, uploaded: uploaded}:
+			case <-partUpCtx.Done():
+				buffers.put(buf)
+				return
+			}
+		}
+	}()
+
+	// 计算：分片的 MD5 和整个文件的 etag
+	var etagHasher *EtagHasher
+	if calcEtag {
+		etagHasher = NewEtagHasher()
+	}
+	go func() {
+		defer stages.Done()
+		defer close(hashedChan)
+		for part := range readChan {
+			if etagHasher != nil {
+				etagHasher.Write(part.data)
+			}
+			if part.uploaded {
+				buffers.put(part.data)
+				continue
+			}
+			sum := md5.Sum(part.data)
+			part.md5 = hex.EncodeToString(sum[:])
+			select {
+			case hashedChan <- part:
+			case <-partUpCtx.Done():
+				buffers.put(part.data)
+				return
+			}
+		}
+	}()
+
+	// 上传：最多 concurrency 个分片同时上传
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for part := range hashedChan {
+				getBody := func() (io.Reader, int) {
+					return bytes.NewReader(part.data), len(part.data)
+				}
+				ret, err := p.uploadPartWithRetry(partUpCtx, bucket, key, hasKey, uploadId, part.partNum, part.md5, getBody)
+				buffers.put(part.data)
+				if err != nil {
+					if partUpCtx.Err() == nil {
+						elog.Error(xl.ReqId(), "uploadPartErr:", part.partNum, err)
+						fail(err)
+					}
+					continue
+				}
+				session.addPart(part.partNum, ret)
+				if partNotify != nil {
+					partNotify(part.partNum, ret.Etag)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	stages.Wait()
+
+	if partUpErr == nil && ctx.Err() != nil {
+		partUpErr = ctx.Err()
+	}
+	if partUpErr != nil {
+		return "", partUpErr
+	}
+	if etagHasher == nil {
+		return "", nil
+	}
+	return etagHasher.Etag(), nil
+}
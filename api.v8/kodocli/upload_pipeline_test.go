@@ -0,0 +1,122 @@
+package kodocli
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"testing"
+)
+
+// 统计读取字节数的 io.ReaderAt
+type countingReaderAt struct {
+	r    io.ReaderAt
+	read int64
+}
+
+func (r *countingReaderAt) ReadAt(b []byte, off int64) (int, error) {
+	n, err := r.r.ReadAt(b, off)
+	atomic.AddInt64(&r.read, int64(n))
+	return n, err
+}
+
+func TestUploadReadAhead(t *testing.T) {
+	server := newFakeUpServer()
+	defer server.Close()
+
+	data := bytes.Repeat([]byte("0123456789abcdef"), 5*EtagBlockSize/16+100)
+	up := NewUploader(0, &UploadConfig{UpHosts: []string{server.URL}, UploadPartSize: EtagBlockSize, Concurrency: 2, VerifyEtag: true, ReadAhead: 2})
+	f := &countingReaderAt{r: bytes.NewReader(data)}
+	var ret CompletePartsRet
+	if err := up.Upload(context.Background(), &ret, fakeUptoken("bucket"), "key", f, int64(len(data)), nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(server.completed, data) {
+		t.Fatal("completed data is not equal")
+	}
+	if etag, _ := GetEtag(bytes.NewReader(data)); ret.Hash != etag {
+		t.Fatalf("unexpected hash: %s", ret.Hash)
+	}
+	if f.read != int64(len(data)) {
+		t.Fatalf("file should be read only once: %d", f.read)
+	}
+
+	// 继续上传时已经上传的分片只读取用于计算 etag
+	server.failPart = func(partNum int) int {
+		if partNum == 3 {
+			return http.StatusBadRequest
+		}
+		return 0
+	}
+	up.KeepSessionOnFailure = true
+	session, err := up.UploadWithSession(context.Background(), nil, fakeUptoken("bucket"), "key", bytes.NewReader(data), int64(len(data)), nil, nil)
+	if err == nil || session == nil {
+		t.Fatalf("upload should fail: %v", err)
+	}
+	server.failPart = nil
+	server.partUploads = make(map[int]int)
+	uploadedParts := append([]UploadedPart(nil), session.Parts...)
+	f = &countingReaderAt{r: bytes.NewReader(data)}
+	if err = up.ResumeUpload(context.Background(), session, f, &ret, fakeUptoken("bucket"), nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(server.completed, data) {
+		t.Fatal("completed data is not equal")
+	}
+	if f.read != int64(len(data)) {
+		t.Fatalf("file should be read only once: %d", f.read)
+	}
+	for _, part := range uploadedParts {
+		if server.partUploads[part.PartNumber] > 0 {
+			t.Fatalf("part %d is uploaded again", part.PartNumber)
+		}
+	}
+}
+
+func TestUploadVerifyEtagWithoutReadAhead(t *testing.T) {
+	server := newFakeUpServer()
+	defer server.Close()
+
+	// 不预读时 etag 在上传分片的同时计算，不会再读取一遍文件
+	data := bytes.Repeat([]byte("0123456789abcdef"), 5*EtagBlockSize/16+100)
+	up := NewUploader(0, &UploadConfig{UpHosts: []string{server.URL}, UploadPartSize: EtagBlockSize, Concurrency: 2, VerifyEtag: true})
+	f := &countingReaderAt{r: bytes.NewReader(data)}
+	var ret CompletePartsRet
+	if err := up.Upload(context.Background(), &ret, fakeUptoken("bucket"), "key", f, int64(len(data)), nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if etag, _ := GetEtag(bytes.NewReader(data)); ret.Hash != etag {
+		t.Fatalf("unexpected hash: %s", ret.Hash)
+	}
+	if f.read != int64(len(data)) {
+		t.Fatalf("file should be read only once: %d", f.read)
+	}
+
+	// 继续上传时已经上传的分片只读取用于计算 etag
+	server.failPart = func(partNum int) int {
+		if partNum == 3 {
+			return http.StatusBadRequest
+		}
+		return 0
+	}
+	up.KeepSessionOnFailure = true
+	session, err := up.UploadWithSession(context.Background(), nil, fakeUptoken("bucket"), "key", bytes.NewReader(data), int64(len(data)), nil, nil)
+	if err == nil || session == nil {
+		t.Fatalf("upload should fail: %v", err)
+	}
+	server.failPart = nil
+	f = &countingReaderAt{r: bytes.NewReader(data)}
+	if err = up.ResumeUpload(context.Background(), session, f, &ret, fakeUptoken("bucket"), nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(server.completed, data) {
+		t.Fatal("completed data is not equal")
+	}
+	if etag, _ := GetEtag(bytes.NewReader(data)); ret.Hash != etag {
+		t.Fatalf("unexpected hash: %s", ret.Hash)
+	}
+	if f.read != int64(len(data)) {
+		t.Fatalf("file should be read only once: %d", f.read)
+	}
+}
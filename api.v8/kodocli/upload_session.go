@@ -0,0 +1,100 @@
+package kodocli
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	ErrSessionExpired = errors.New("upload session is expired")
+	ErrInvalidSession = errors.New("invalid upload session")
+)
+
+// 分片上传会话，记录 uploadId 和已经上传成功的分片，可以序列化为 JSON 保存，之后通过 ResumeUpload 只上传缺失的分片
+// 上传过程中会并发修改会话，需要在上传结束后再序列化
+type UploadSession struct {
+	UploadId  string         `json:"uploadId"`
+	Bucket    string         `json:"bucket"`
+	Key       string         `json:"key"`
+	HasKey    bool           `json:"hasKey"`
+	PartSizes []int64        `json:"partSizes"`
+	Parts     []UploadedPart `json:"parts"`
+	// 会话的过期时间（Unix 时间戳，单位为秒），为 0 表示服务端没有返回
+	ExpireAt int64 `json:"expireAt,omitempty"`
+
+	lock sync.Mutex
+}
+
+// 已经上传成功的分片
+type UploadedPart struct {
+	PartNumber int    `json:"partNumber"`
+	Etag       string `json:"etag"`
+	Md5        string `json:"md5"`
+}
+
+// 会话是否已经过期
+func (s *UploadSession) Expired() bool {
+	return s.ExpireAt > 0 && time.Now().Unix() >= s.ExpireAt
+}
+
+// 会话中所有分片的总大小
+func (s *UploadSession) Size() (size int64) {
+	for _, partSize := range s.PartSizes {
+		size += partSize
+	}
+	return
+}
+
+func (s *UploadSession) hasPart(partNum int) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, part := range s.Parts {
+		if part.PartNumber == partNum {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *UploadSession) addPart(partNum int, ret UploadPartRet) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.Parts = append(s.Parts, UploadedPart{PartNumber: partNum, Etag: ret.Etag, Md5: ret.Md5})
+}
+
+func (s *UploadSession) completedParts() []Part {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	sort.Slice(s.Parts, func(i, j int) bool { return s.Parts[i].PartNumber < s.Parts[j].PartNumber })
+	parts := make([]Part, len(s.Parts))
+	for i, part := range s.Parts {
+		parts[i] = Part{PartNumber: part.PartNumber, Etag: part.Etag}
+	}
+	return parts
+}
+
+// 和 Upload 相同，同时返回上传会话。
+// 设置了 KeepSessionOnFailure 时，分片上传失败不会删除会话，可以保存返回的会话，之后通过 ResumeUpload 继续上传。
+func (p Uploader) UploadWithSession(ctx context.Context, ret interface{}, uptoken string, key string, f io.ReaderAt, fsize int64,
+	mp *CompleteMultipart, partNotify func(partIdx int, etag string)) (*UploadSession, error) {
+	uploadParts := p.makeUploadParts(fsize)
+	return p.uploadWithSession(ctx, ret, uptoken, key, true, f, fsize, true, uploadParts, mp, partNotify)
+}
+
+// 继续上传会话中缺失的分片并合并，f 必须和创建会话时的数据一致。
+// 已经上传的分片不会重新上传，partNotify 只会通知本次上传的分片。
+func (p Uploader) ResumeUpload(ctx context.Context, session *UploadSession, f io.ReaderAt, ret interface{}, uptoken string,
+	mp *CompleteMultipart, partNotify func(partIdx int, etag string)) error {
+	if session == nil || session.UploadId == "" || len(session.PartSizes) == 0 {
+		return ErrInvalidSession
+	}
+	if session.Expired() {
+		return ErrSessionExpired
+	}
+	ctx = withUptoken(ctx, uptoken)
+	return p.uploadSessionParts(ctx, ret, session, f, p.Concurrency, mp, partNotify)
+}
@@ -0,0 +1,246 @@
+package kodocli
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 模拟分片上传 v2 接口的服务端
+type fakeUpServer struct {
+	*httptest.Server
+	lock        sync.Mutex
+	parts       map[int][]byte
+	partUploads map[int]int
+	deleted     []string
+	completed   []byte
+	uploads     []MultipartUpload
+	putPaths    []string
+	// 前 failPuts 次 Put2 请求返回 failPutCode，failPutCode 为 0 时返回 500
+	failPuts    int
+	failPutCode int
+	// 分片上传 v1 的块，以 ctx 为键
+	blocks map[string][]byte
+	mkblks int
+	// 为 true 时初始化分片上传 v2 返回 405
+	noV2 bool
+	// 请求中带有 key 时记录其 Authorization 头
+	auths map[string]string
+	// 返回 true 时请求返回 401
+	rejectAuth func(auth string, paths []string) bool
+	// 返回非 0 时上传分片失败，使用返回值作为状态码
+	failPart func(partNum int) int
+}
+
+func newFakeUpServer() *fakeUpServer {
+	s := &fakeUpServer{parts: make(map[int][]byte), partUploads: make(map[int]int), blocks: make(map[string][]byte), auths: make(map[string]string)}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+func (s *fakeUpServer) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	paths := strings.Split(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if key, ok := requestKey(paths); ok {
+		s.auths[key] = r.Header.Get("Authorization")
+	}
+	if s.rejectAuth != nil && s.rejectAuth(r.Header.Get("Authorization"), paths) {
+		ioutil.ReadAll(r.Body)
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "bad token"})
+		return
+	}
+	switch {
+	case r.Method == "POST" && paths[0] == "put":
+		data, _ := ioutil.ReadAll(r.Body)
+		s.putPaths = append(s.putPaths, r.URL.Path)
+		if s.failPuts > 0 {
+			s.failPuts--
+			code := s.failPutCode
+			if code == 0 {
+				code = http.StatusInternalServerError
+			}
+			w.WriteHeader(code)
+			json.NewEncoder(w).Encode(map[string]string{"error": "put failed"})
+			return
+		}
+		s.completed = data
+		etag, _ := GetEtag(bytes.NewReader(data))
+		json.NewEncoder(w).Encode(PutRet{Hash: etag})
+	case r.Method == "POST" && paths[0] == "":
+		file, _, err := r.FormFile("file")
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		data, _ := ioutil.ReadAll(file)
+		s.completed = data
+		etag, _ := GetEtag(bytes.NewReader(data))
+		json.NewEncoder(w).Encode(PutRet{Hash: etag})
+	case r.Method == "POST" && paths[0] == "mkblk":
+		data, _ := ioutil.ReadAll(r.Body)
+		s.mkblks++
+		blkCtx := fmt.Sprint("ctx-", s.mkblks)
+		s.blocks[blkCtx] = data
+		json.NewEncoder(w).Encode(BlkputRet{Ctx: blkCtx, Crc32: crc32.ChecksumIEEE(data), Offset: uint32(len(data)), Host: s.URL})
+	case r.Method == "POST" && paths[0] == "bput":
+		data, _ := ioutil.ReadAll(r.Body)
+		s.blocks[paths[1]] = append(s.blocks[paths[1]], data...)
+		json.NewEncoder(w).Encode(BlkputRet{Ctx: paths[1], Crc32: crc32.ChecksumIEEE(data), Offset: uint32(len(s.blocks[paths[1]])), Host: s.URL})
+	case r.Method == "POST" && paths[0] == "mkfile":
+		body, _ := ioutil.ReadAll(r.Body)
+		var data []byte
+		for _, blkCtx := range strings.Split(string(body), ",") {
+			data = append(data, s.blocks[blkCtx]...)
+		}
+		s.completed = data
+		etag, _ := GetEtag(bytes.NewReader(data))
+		json.NewEncoder(w).Encode(PutRet{Hash: etag})
+	case r.Method == "POST" && len(paths) == 5 && s.noV2:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]string{"error": "method not allowed"})
+	case r.Method == "POST" && len(paths) == 5:
+		json.NewEncoder(w).Encode(map[string]interface{}{"uploadId": "upload-id", "expireAt": time.Now().Add(time.Hour).Unix()})
+	case r.Method == "PUT" && len(paths) == 7:
+		partNum, _ := strconv.Atoi(paths[6])
+		data, _ := ioutil.ReadAll(r.Body)
+		s.partUploads[partNum]++
+		if s.failPart != nil {
+			if code := s.failPart(partNum); code != 0 {
+				w.WriteHeader(code)
+				json.NewEncoder(w).Encode(map[string]string{"error": "part failed"})
+				return
+			}
+		}
+		s.parts[partNum] = data
+		sum := md5.Sum(data)
+		json.NewEncoder(w).Encode(UploadPartRet{Etag: fmt.Sprint("etag-", partNum), Md5: hex.EncodeToString(sum[:])})
+	case r.Method == "POST" && len(paths) == 6:
+		var mp CompleteMultipart
+		json.NewDecoder(r.Body).Decode(&mp)
+		var data []byte
+		for _, part := range mp.Parts {
+			data = append(data, s.parts[part.PartNumber]...)
+		}
+		s.completed = data
+		etag, _ := GetEtag(bytes.NewReader(data))
+		json.NewEncoder(w).Encode(CompletePartsRet{Hash: etag, Key: paths[3]})
+	case r.Method == "GET" && len(paths) == 6:
+		s.listParts(w, r)
+	case r.Method == "GET" && len(paths) == 3 && paths[2] == "uploads":
+		json.NewEncoder(w).Encode(listUploadsRet{Uploads: s.uploads})
+	case r.Method == "DELETE":
+		s.deleted = append(s.deleted, paths[5])
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (s *fakeUpServer) listParts(w http.ResponseWriter, r *http.Request) {
+	limit, _ := strconv.Atoi(r.URL.Query().Get("max-parts"))
+	marker, _ := strconv.Atoi(r.URL.Query().Get("part-number-marker"))
+	var ret listPartsRet
+	for partNum := marker + 1; partNum <= 10000 && len(ret.Parts) < limit; partNum++ {
+		if data, ok := s.parts[partNum]; ok {
+			ret.Parts = append(ret.Parts, ListedPart{PartNumber: partNum, Etag: fmt.Sprint("etag-", partNum), Size: int64(len(data))})
+			ret.PartNumberMarker = partNum
+		}
+	}
+	json.NewEncoder(w).Encode(ret)
+}
+
+func requestKey(paths []string) (string, bool) {
+	var encoded string
+	if len(paths) > 3 && paths[0] == "buckets" && paths[2] == "objects" {
+		encoded = paths[3]
+	} else {
+		for i := 0; i+1 < len(paths); i++ {
+			if paths[i] == "key" {
+				encoded = paths[i+1]
+			}
+		}
+	}
+	key, err := base64.URLEncoding.DecodeString(encoded)
+	return string(key), err == nil && encoded != ""
+}
+
+func fakeUptoken(bucket string) string {
+	return fakeUptokenWith("sign", bucket, time.Now().Add(time.Hour))
+}
+
+func fakeUptokenWith(sign, bucket string, deadline time.Time) string {
+	policy, _ := json.Marshal(map[string]interface{}{"scope": bucket, "deadline": deadline.Unix()})
+	return "ak:" + sign + ":" + base64.URLEncoding.EncodeToString(policy)
+}
+
+func TestResumeUpload(t *testing.T) {
+	server := newFakeUpServer()
+	defer server.Close()
+	server.failPart = func(partNum int) int {
+		if partNum == 2 {
+			return http.StatusBadRequest
+		}
+		return 0
+	}
+
+	data := bytes.Repeat([]byte("0123456789abcdef"), 3*EtagBlockSize/16+100)
+	up := NewUploader(0, &UploadConfig{UpHosts: []string{server.URL}, UploadPartSize: EtagBlockSize, Concurrency: 1, VerifyEtag: true})
+	up.KeepSessionOnFailure = true
+	session, err := up.UploadWithSession(context.Background(), nil, fakeUptoken("bucket"), "key", bytes.NewReader(data), int64(len(data)), nil, nil)
+	if err == nil || session == nil {
+		t.Fatalf("upload should fail and keep session: %v", err)
+	}
+	if len(server.deleted) > 0 {
+		t.Fatal("session should not be deleted")
+	}
+	if len(session.PartSizes) != 4 || session.Size() != int64(len(data)) || session.Expired() {
+		t.Fatalf("unexpected session: %+v", session)
+	}
+
+	saved, err := json.Marshal(session)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var restored UploadSession
+	if err = json.Unmarshal(saved, &restored); err != nil {
+		t.Fatal(err)
+	}
+
+	server.failPart = nil
+	var ret CompletePartsRet
+	err = up.ResumeUpload(context.Background(), &restored, bytes.NewReader(data), &ret, fakeUptoken("bucket"), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(server.completed, data) {
+		t.Fatal("completed data is not equal")
+	}
+	for partNum, count := range server.partUploads {
+		if count != 1 && partNum != 2 {
+			t.Fatalf("part %d is uploaded %d times", partNum, count)
+		}
+	}
+	if len(restored.Parts) != 4 {
+		t.Fatalf("unexpected parts: %+v", restored.Parts)
+	}
+
+	restored.ExpireAt = time.Now().Add(-time.Minute).Unix()
+	if err = up.ResumeUpload(context.Background(), &restored, bytes.NewReader(data), nil, fakeUptoken("bucket"), nil, nil); err != ErrSessionExpired {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
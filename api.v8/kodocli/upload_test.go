@@ -0,0 +1,240 @@
+package kodocli
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/qiniupd/qiniu-go-sdk/x/httputil.v1"
+)
+
+func TestPut2VerifyEtag(t *testing.T) {
+	data := []byte("hello world")
+	etag, _ := GetEtag(bytes.NewReader(data))
+	remoteHash := etag
+	var requestUrl string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestUrl = r.URL.Path
+		ioutil.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(PutRet{Hash: remoteHash, Key: "key"})
+	}))
+	defer server.Close()
+
+	up := NewUploader(0, &UploadConfig{UpHosts: []string{server.URL}, VerifyEtag: true})
+	var ret PutRet
+	err := up.Put2(context.Background(), &ret, "uptoken", "key", bytes.NewReader(data), int64(len(data)), &PutExtra{Crc32: CalcAndCheckCrc})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ret.Hash != etag {
+		t.Fatalf("unexpected hash: %s", ret.Hash)
+	}
+	if !strings.Contains(requestUrl, "/crc32/"+strconv.FormatUint(uint64(crc32.ChecksumIEEE(data)), 10)+"/") {
+		t.Fatalf("crc32 is not calculated: %s", requestUrl)
+	}
+
+	remoteHash = "FpLiADEaVoALPkdb8tJEJyRTXoe_"
+	err = up.Put2(context.Background(), nil, "uptoken", "key", bytes.NewReader(data), int64(len(data)), nil)
+	if err != ErrEtagNotMatch {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestEtagCompatible(t *testing.T) {
+	cases := []struct {
+		partSizes  []int64
+		compatible bool
+	}{
+		{[]int64{100}, true},
+		{[]int64{EtagBlockSize, 100}, true},
+		{[]int64{2 * EtagBlockSize, 2 * EtagBlockSize, 1}, true},
+		{[]int64{5 << 20, 5 << 20}, false},
+	}
+	for _, c := range cases {
+		if etagCompatible(c.partSizes) != c.compatible {
+			t.Fatalf("unexpected result of %v", c.partSizes)
+		}
+	}
+}
+
+func TestPutReader(t *testing.T) {
+	server := newFakeUpServer()
+	defer server.Close()
+	up := NewUploader(0, &UploadConfig{UpHosts: []string{server.URL}, UploadPartSize: EtagBlockSize, VerifyEtag: true})
+
+	cases := []struct {
+		size      int
+		multipart bool
+	}{
+		{0, false},
+		{100, false},
+		{EtagBlockSize, false},
+		{2*EtagBlockSize + 1, true},
+	}
+	for _, c := range cases {
+		server.completed, server.putPaths = nil, nil
+		data := make([]byte, c.size)
+		for i := range data {
+			data[i] = byte(i % 251)
+		}
+		var fsize, uploaded int64
+		extra := PutExtra{MimeType: "text/plain", Params: map[string]string{"x:a": "b"}, OnProgress: func(s, u int64) {
+			fsize, uploaded = s, u
+		}}
+		var ret PutRet
+		if err := up.PutReader(context.Background(), &ret, fakeUptoken("bucket"), "key", bytes.NewReader(data), &extra); err != nil {
+			t.Fatal(c.size, err)
+		}
+		if !bytes.Equal(server.completed, data) {
+			t.Fatalf("unexpected data of size %d: %d", c.size, len(server.completed))
+		}
+		if (len(server.putPaths) == 0) != c.multipart {
+			t.Fatalf("unexpected protocol of size %d", c.size)
+		}
+		if fsize != int64(c.size) || uploaded != int64(c.size) {
+			t.Fatalf("unexpected progress of size %d: %d %d", c.size, fsize, uploaded)
+		}
+		if etag, _ := GetEtag(bytes.NewReader(data)); ret.Hash != etag {
+			t.Fatalf("unexpected hash of size %d: %s", c.size, ret.Hash)
+		}
+	}
+}
+
+func TestPutReaderBoundedMemory(t *testing.T) {
+	server := newFakeUpServer()
+	defer server.Close()
+	// 只能缓存一个分片时，开头已经读出的数据占用唯一的缓冲区
+	up := NewUploader(0, &UploadConfig{UpHosts: []string{server.URL}, UploadPartSize: EtagBlockSize, Concurrency: 2,
+		StreamMemoryLimit: EtagBlockSize, VerifyEtag: true})
+
+	data := make([]byte, 3*EtagBlockSize+5)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	var ret PutRet
+	if err := up.PutReader(context.Background(), &ret, fakeUptoken("bucket"), "key", bytes.NewReader(data), nil); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(server.completed, data) {
+		t.Fatal("completed data is not equal")
+	}
+	if etag, _ := GetEtag(bytes.NewReader(data)); ret.Hash != etag {
+		t.Fatalf("unexpected hash: %s", ret.Hash)
+	}
+}
+
+func TestReadAtMost(t *testing.T) {
+	buf, err := readAtMost(bytes.NewReader(make([]byte, 100)), EtagBlockSize+1)
+	if err != nil || len(buf) != 100 || cap(buf) > 64*1024 {
+		t.Fatalf("unexpected buffer: %d %d %v", len(buf), cap(buf), err)
+	}
+	buf, err = readAtMost(bytes.NewReader(make([]byte, 2*EtagBlockSize)), EtagBlockSize+1)
+	if err != nil || len(buf) != EtagBlockSize+1 || cap(buf) != EtagBlockSize+1 {
+		t.Fatalf("unexpected buffer: %d %d %v", len(buf), cap(buf), err)
+	}
+}
+
+func TestPut2Retry(t *testing.T) {
+	server := newFakeUpServer()
+	defer server.Close()
+	server.failPuts = 1
+	up := NewUploader(0, &UploadConfig{UpHosts: []string{server.URL}, VerifyEtag: true})
+
+	data := bytes.Repeat([]byte("x"), 1000)
+	var uploaded int64
+	extra := PutExtra{XMeta: map[string]string{"a": "b"}, OnProgress: func(fsize, n int64) {
+		uploaded = n
+	}}
+	var ret PutRet
+	if err := up.Put2(context.Background(), &ret, "uptoken", "key", bytes.NewReader(data), int64(len(data)), &extra); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(server.completed, data) || len(server.putPaths) != 2 {
+		t.Fatalf("unexpected upload: %d %v", len(server.completed), server.putPaths)
+	}
+	if !strings.Contains(server.putPaths[1], "/x-qn-meta-a/") {
+		t.Fatalf("meta is not sent: %s", server.putPaths[1])
+	}
+	if uploaded != int64(len(data)) {
+		t.Fatalf("unexpected progress: %d", uploaded)
+	}
+
+	// 614 等 6xx 错误不重试
+	server.putPaths = nil
+	server.failPuts, server.failPutCode = formUploadRetryTimes, 614
+	err := up.Put2(context.Background(), nil, "uptoken", "key", bytes.NewReader(data), int64(len(data)), nil)
+	if httputil.DetectCode(err) != 614 || len(server.putPaths) != 1 {
+		t.Fatalf("unexpected result: %v %v", err, server.putPaths)
+	}
+	if _, failed := hostsScores.Load(server.URL); failed {
+		t.Fatal("host should not be marked as failed")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := up.Put2(ctx, nil, "uptoken", "key", bytes.NewReader(data), int64(len(data)), nil); err != context.Canceled {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestUploaderConcurrentUse(t *testing.T) {
+	server := newFakeUpServer()
+	defer server.Close()
+	up := NewUploader(0, &UploadConfig{UpHosts: []string{server.URL}})
+
+	var wg sync.WaitGroup
+	uptokens := make([]string, 8)
+	for i := range uptokens {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			data := bytes.Repeat([]byte{byte(i)}, 1000*(i+1))
+			uptoken, key := fakeUptoken(fmt.Sprint("bucket-", i)), fmt.Sprint("key-", i)
+			uptokens[i] = uptoken
+			var err error
+			if i%2 == 0 {
+				err = up.Put2(context.Background(), nil, uptoken, key, bytes.NewReader(data), int64(len(data)), nil)
+			} else {
+				err = up.Rput(context.Background(), nil, uptoken, key, bytes.NewReader(data), int64(len(data)), nil)
+			}
+			if err != nil {
+				t.Error(i, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for i, uptoken := range uptokens {
+		if auth := server.auths[fmt.Sprint("key-", i)]; auth != "UpToken "+uptoken {
+			t.Fatalf("unexpected uptoken of upload %d: %s", i, auth)
+		}
+	}
+	if up.Conn.Client.Transport != nil {
+		t.Fatal("client of uploader is changed")
+	}
+}
+
+func TestUploaderTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer server.Close()
+	up := NewUploader(0, &UploadConfig{UpHosts: []string{server.URL}, Timeout: 20 * time.Millisecond})
+
+	data := []byte("hello world")
+	err := up.Rput(context.Background(), nil, "uptoken", "key", bytes.NewReader(data), int64(len(data)), &RputExtra{TryTimes: 1})
+	if err != ErrPutFailed {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,163 @@
+package kodocli
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/qiniupd/qiniu-go-sdk/api.v8/kodo"
+	"github.com/qiniupd/qiniu-go-sdk/x/rpc.v7"
+)
+
+// 上传凭证在过期前多久重新获取
+const uptokenRefreshBefore = 10 * time.Minute
+
+// 上传凭证来源，每次调用返回一个新的上传凭证，用于耗时可能超过凭证有效期的上传
+type UptokenSource func() (string, error)
+
+type uptokenKey struct{}
+
+// 上传过程中使用的上传凭证，设置了 source 时可以在快要过期或失效后重新获取
+type uptokenHolder struct {
+	source   UptokenSource
+	lock     sync.Mutex
+	token    string
+	deadline int64
+}
+
+// 将上传凭证附加到 ctx 中，之后使用该 ctx 发起的上传请求都会带上这个凭证。
+// 如果 ctx 中已经有上传凭证来源，则继续使用它。
+func withUptoken(ctx context.Context, uptoken string) context.Context {
+	if h, ok := ctx.Value(uptokenKey{}).(*uptokenHolder); ok && h.source != nil {
+		return ctx
+	}
+	return context.WithValue(ctx, uptokenKey{}, &uptokenHolder{token: uptoken})
+}
+
+// 将上传凭证来源附加到 ctx 中，返回第一次获取的上传凭证
+func withUptokenSource(ctx context.Context, source UptokenSource) (context.Context, string, error) {
+	h := &uptokenHolder{source: source}
+	uptoken, err := h.get()
+	if err != nil {
+		return nil, "", err
+	}
+	return context.WithValue(ctx, uptokenKey{}, h), uptoken, nil
+}
+
+// 返回一个不会被取消的 ctx，带有 ctx 中的上传凭证，用于上传失败后的清理
+func detachUptoken(ctx context.Context) context.Context {
+	if h, ok := ctx.Value(uptokenKey{}).(*uptokenHolder); ok {
+		return context.WithValue(context.Background(), uptokenKey{}, h)
+	}
+	return context.Background()
+}
+
+// ctx 中的上传凭证失效后是否可以重新获取
+func uptokenRefreshable(ctx context.Context) bool {
+	h, ok := ctx.Value(uptokenKey{}).(*uptokenHolder)
+	return ok && h.source != nil
+}
+
+func (h *uptokenHolder) get() (string, error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.token != "" && (h.source == nil || h.deadline == 0 || time.Now().Add(uptokenRefreshBefore).Unix() < h.deadline) {
+		return h.token, nil
+	}
+	token, err := h.source()
+	if err != nil {
+		return "", err
+	}
+	h.token, h.deadline = token, 0
+	if policy, err := kodo.ParseUptoken(token); err == nil {
+		h.deadline = int64(policy.Expires)
+	}
+	return token, nil
+}
+
+// 服务端认为 token 无效时调用，如果它仍是当前凭证则丢弃，返回是否可以重新获取
+func (h *uptokenHolder) invalidate(token string) bool {
+	if h.source == nil {
+		return false
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.token == token {
+		h.token = ""
+	}
+	return true
+}
+
+// 发起上传请求，如果 ctx 中带有上传凭证则设置到请求头中。
+// 凭证按请求设置，不修改 p.Conn，所以同一个 Uploader 可以被不同的上传凭证并发使用。
+// 服务端返回 401 且凭证可以重新获取时，请求体可以重新读取的请求会使用新凭证重发一次。
+func (p Uploader) do(ctx context.Context, req *http.Request) (*http.Response, error) {
+	conn := p.Conn
+	if conn.Client == nil {
+		conn = rpc.DefaultClient
+	}
+	h, ok := ctx.Value(uptokenKey{}).(*uptokenHolder)
+	if !ok {
+		return conn.Do(ctx, req)
+	}
+	uptoken, err := h.get()
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "UpToken "+uptoken)
+	resp, err := conn.Do(ctx, req)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized || !h.invalidate(uptoken) {
+		return resp, err
+	}
+	if req.Body != nil && req.GetBody == nil {
+		return resp, nil
+	}
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return resp, nil
+		}
+		req.Body = body
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if uptoken, err = h.get(); err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "UpToken "+uptoken)
+	return conn.Do(ctx, req)
+}
+
+// 和 Upload 相同，上传凭证从 source 获取。
+// 凭证快要过期或者服务端返回 401 时重新获取，继续使用同一个 uploadId 上传。
+func (p Uploader) UploadWithUptokenSource(ctx context.Context, ret interface{}, source UptokenSource, key string, f io.ReaderAt, fsize int64,
+	mp *CompleteMultipart, partNotify func(partIdx int, etag string)) error {
+	ctx, uptoken, err := withUptokenSource(ctx, source)
+	if err != nil {
+		return err
+	}
+	return p.Upload(ctx, ret, uptoken, key, f, fsize, mp, partNotify)
+}
+
+// 和 StreamUploadWithMultipart 相同，上传凭证从 source 获取，见 UploadWithUptokenSource。
+func (p Uploader) StreamUploadWithUptokenSource(ctx context.Context, ret interface{}, source UptokenSource, key string, reader io.Reader,
+	mp *CompleteMultipart, partNotify func(partIdx int, etag string)) error {
+	ctx, uptoken, err := withUptokenSource(ctx, source)
+	if err != nil {
+		return err
+	}
+	return p.StreamUploadWithMultipart(ctx, ret, uptoken, key, reader, mp, partNotify)
+}
+
+// 和 ResumeUpload 相同，上传凭证从 source 获取，见 UploadWithUptokenSource。
+func (p Uploader) ResumeUploadWithUptokenSource(ctx context.Context, session *UploadSession, f io.ReaderAt, ret interface{}, source UptokenSource,
+	mp *CompleteMultipart, partNotify func(partIdx int, etag string)) error {
+	ctx, uptoken, err := withUptokenSource(ctx, source)
+	if err != nil {
+		return err
+	}
+	return p.ResumeUpload(ctx, session, f, ret, uptoken, mp, partNotify)
+}
@@ -0,0 +1,63 @@
+package kodocli
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUploadWithUptokenSource(t *testing.T) {
+	server := newFakeUpServer()
+	defer server.Close()
+	// 第一个凭证在上传第一个分片之后失效
+	server.rejectAuth = func(auth string, paths []string) bool {
+		if !strings.Contains(auth, ":sign1:") {
+			return false
+		}
+		if len(paths) == 7 {
+			partNum, _ := strconv.Atoi(paths[6])
+			return partNum > 1
+		}
+		return len(paths) == 6
+	}
+
+	calls := 0
+	source := func() (string, error) {
+		calls++
+		return fakeUptokenWith(fmt.Sprint("sign", calls), "bucket", time.Now().Add(time.Hour)), nil
+	}
+	data := bytes.Repeat([]byte("0123456789abcdef"), 3*EtagBlockSize/16+100)
+	up := NewUploader(0, &UploadConfig{UpHosts: []string{server.URL}, UploadPartSize: EtagBlockSize, Concurrency: 1})
+	err := up.UploadWithUptokenSource(context.Background(), nil, source, "key", bytes.NewReader(data), int64(len(data)), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls != 2 {
+		t.Fatalf("unexpected uptoken refresh count: %d", calls)
+	}
+	if !bytes.Equal(server.completed, data) || len(server.deleted) > 0 {
+		t.Fatal("upload is not continued with the same uploadId")
+	}
+	if !strings.Contains(server.auths["key"], ":sign2:") {
+		t.Fatalf("unexpected uptoken: %s", server.auths["key"])
+	}
+
+	// 快要过期的凭证在每次请求前都重新获取
+	calls = 0
+	server.rejectAuth = nil
+	source = func() (string, error) {
+		calls++
+		return fakeUptokenWith(fmt.Sprint("sign", calls), "bucket", time.Now().Add(time.Minute)), nil
+	}
+	err = up.UploadWithUptokenSource(context.Background(), nil, source, "key", bytes.NewReader(data), int64(len(data)), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls < 6 {
+		t.Fatalf("uptoken is not refreshed before deadline: %d", calls)
+	}
+}
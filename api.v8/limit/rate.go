@@ -0,0 +1,149 @@
+package limit
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// 令牌桶限速器，按字节数限制速率，可以在运行时调整速率。
+// nil 或速率不大于 0 的限速器不做任何限制，可以被多个 goroutine 共享。
+type RateLimiter struct {
+	mu     sync.Mutex
+	rate   int64 // 每秒允许通过的字节数
+	burst  int64 // 桶的容量
+	tokens float64
+	last   time.Time
+}
+
+// 创建限速器，rate 为每秒允许通过的字节数，burst 为允许突发的字节数，不大于 0 时取 rate
+func NewRateLimiter(rate, burst int64) *RateLimiter {
+	l := &RateLimiter{}
+	l.SetRate(rate, burst)
+	return l
+}
+
+// 调整速率，rate 不大于 0 时不限速
+func (l *RateLimiter) SetRate(rate, burst int64) {
+	if burst <= 0 {
+		burst = rate
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refill(time.Now())
+	l.rate = rate
+	l.burst = burst
+	if l.tokens > float64(burst) {
+		l.tokens = float64(burst)
+	}
+}
+
+// 当前速率，不限速时返回 0
+func (l *RateLimiter) Rate() int64 {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rate < 0 {
+		return 0
+	}
+	return l.rate
+}
+
+func (l *RateLimiter) refill(now time.Time) {
+	if l.rate > 0 && !l.last.IsZero() {
+		l.tokens += now.Sub(l.last).Seconds() * float64(l.rate)
+		if l.tokens > float64(l.burst) {
+			l.tokens = float64(l.burst)
+		}
+	}
+	l.last = now
+}
+
+// 等待 n 个字节的令牌，ctx 被取消时返回 ctx.Err()
+func (l *RateLimiter) WaitN(ctx context.Context, n int) error {
+	if l == nil {
+		return nil
+	}
+	for n > 0 {
+		l.mu.Lock()
+		if l.rate <= 0 {
+			l.mu.Unlock()
+			return nil
+		}
+		chunk := int64(n)
+		if chunk > l.burst {
+			chunk = l.burst
+		}
+		l.refill(time.Now())
+		l.tokens -= float64(chunk)
+		var wait time.Duration
+		if l.tokens < 0 {
+			wait = time.Duration(-l.tokens / float64(l.rate) * float64(time.Second))
+		}
+		l.mu.Unlock()
+
+		n -= int(chunk)
+		if wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return ctx.Err()
+			case <-timer.C:
+			}
+		}
+	}
+	return nil
+}
+
+// 依次等待多个限速器，用于同时受全局和局部限速的场景
+func waitAll(ctx context.Context, limiters []*RateLimiter, n int) error {
+	for _, l := range limiters {
+		if err := l.WaitN(ctx, n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type rateLimitedReader struct {
+	ctx      context.Context
+	r        io.Reader
+	limiters []*RateLimiter
+}
+
+// 对读取的字节数限速，limiters 中的 nil 会被忽略
+func NewRateLimitedReader(ctx context.Context, r io.Reader, limiters ...*RateLimiter) io.Reader {
+	return &rateLimitedReader{ctx: ctx, r: r, limiters: limiters}
+}
+
+func (r *rateLimitedReader) Read(p []byte) (n int, err error) {
+	n, err = r.r.Read(p)
+	if n > 0 {
+		if werr := waitAll(r.ctx, r.limiters, n); werr != nil {
+			return n, werr
+		}
+	}
+	return
+}
+
+type rateLimitedWriter struct {
+	ctx      context.Context
+	w        io.Writer
+	limiters []*RateLimiter
+}
+
+// 对写入的字节数限速，limiters 中的 nil 会被忽略
+func NewRateLimitedWriter(ctx context.Context, w io.Writer, limiters ...*RateLimiter) io.Writer {
+	return &rateLimitedWriter{ctx: ctx, w: w, limiters: limiters}
+}
+
+func (w *rateLimitedWriter) Write(p []byte) (n int, err error) {
+	if err = waitAll(w.ctx, w.limiters, len(p)); err != nil {
+		return 0, err
+	}
+	return w.w.Write(p)
+}
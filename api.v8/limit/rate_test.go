@@ -0,0 +1,50 @@
+package limit
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimiterUnlimited(t *testing.T) {
+	var l *RateLimiter
+	assert.NoError(t, l.WaitN(context.Background(), 1<<30))
+	assert.Equal(t, int64(0), l.Rate())
+
+	l = NewRateLimiter(0, 0)
+	start := time.Now()
+	n, err := io.Copy(ioutil.Discard, NewRateLimitedReader(context.Background(), bytes.NewReader(make([]byte, 1<<20)), l, nil))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1<<20), n)
+	assert.True(t, time.Since(start) < time.Second)
+}
+
+func TestRateLimiterWait(t *testing.T) {
+	l := NewRateLimiter(100*1024, 0)
+	// 桶初始为空，200KB 至少需要 2 秒，调整速率后变为 1 秒左右
+	l.SetRate(200*1024, 0)
+	start := time.Now()
+	var buf bytes.Buffer
+	n, err := io.Copy(NewRateLimitedWriter(context.Background(), &buf, l), bytes.NewReader(make([]byte, 200*1024)))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(200*1024), n)
+	elapsed := time.Since(start)
+	assert.True(t, elapsed >= 800*time.Millisecond, elapsed)
+	assert.True(t, elapsed < 2*time.Second, elapsed)
+	assert.Equal(t, int64(200*1024), l.Rate())
+}
+
+func TestRateLimiterCancel(t *testing.T) {
+	l := NewRateLimiter(1024, 0)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := l.WaitN(ctx, 10*1024)
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.True(t, time.Since(start) < time.Second)
+}
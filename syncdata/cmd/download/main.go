@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/qiniupd/qiniu-go-sdk/syncdata/operation"
+)
+
+func main() {
+	cf := flag.String("c", "cfg.toml", "config")
+	dir := flag.String("d", ".", "local directory")
+	prefix := flag.String("p", "", "key prefix")
+	concurrency := flag.Int("j", 4, "download concurrency")
+	flag.Parse()
+
+	x, err := operation.Load(*cf)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-interrupt
+		cancel()
+	}()
+
+	result, err := operation.DownloadPrefix(ctx, operation.NewDownloader(x), operation.NewLister(x), *prefix, *dir,
+		&operation.DownloadPrefixOptions{Concurrency: *concurrency})
+	if result != nil {
+		for _, failed := range result.Failed {
+			fmt.Println("failed:", failed)
+		}
+		fmt.Println(result)
+	}
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if len(result.Failed) > 0 {
+		os.Exit(1)
+	}
+}
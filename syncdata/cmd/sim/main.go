@@ -14,31 +14,48 @@ import (
 
 func main() {
 	c := flag.String("c", "cfg.json", "config file")
+	timeout := flag.Duration("shutdown-timeout", 10*time.Minute, "max time to wait for running uploads when shutting down")
 	flag.Parse()
 	config, err := operation.Load(*c)
 	if err != nil {
 		fmt.Println(err)
-		return
+		os.Exit(1)
 	}
 	srv, err := operation.StartServer(config)
 	if err != nil {
 		fmt.Println(err)
-		return
+		os.Exit(1)
 	}
 
 	if config.Sim {
 		operation.StartSimulateErrorServer(config)
 	}
 
-	shutdown := make(chan os.Signal)
-	signal.Notify(shutdown, os.Interrupt, os.Kill, syscall.SIGTERM)
-	<-shutdown
+	shutdown := make(chan os.Signal, 1)
+	signal.Notify(shutdown, os.Interrupt, syscall.SIGTERM)
+	select {
+	case <-shutdown:
+	case err = <-srv.Err():
+		fmt.Println("upload server failed: ", err)
+	}
 	fmt.Println("shutting down upload server ...")
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
 	defer cancel()
-	if err := srv.Shutdown(ctx); err != nil {
-		fmt.Println("upload server shut down failed: ", err)
+	go func() {
+		// 再次收到信号时不再等待正在上传的文件
+		<-shutdown
+		cancel()
+	}()
+	report, shutdownErr := srv.Shutdown(ctx)
+	if shutdownErr != nil {
+		fmt.Println("upload server shut down failed: ", shutdownErr)
+	}
+	for _, item := range report.Unfinished {
+		fmt.Println("unfinished:", item.JobId, item.Path, item.Status)
 	}
 	fmt.Println("upload server exiting")
+	if err != nil || shutdownErr != nil {
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,564 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/qiniupd/qiniu-go-sdk/api.v8/kodocli"
+	"github.com/qiniupd/qiniu-go-sdk/syncdata/operation"
+	"github.com/qiniupd/qiniu-go-sdk/x/httputil.v1"
+	"github.com/qiniupd/qiniu-go-sdk/x/rpc.v7"
+)
+
+// 退出码
+const (
+	exitOK       = 0
+	exitFailure  = 1
+	exitUsage    = 2
+	exitNotFound = 3
+	exitConfig   = 4
+)
+
+var (
+	errUsage    = errors.New("invalid arguments")
+	errNotFound = errors.New("not found")
+)
+
+type cli struct {
+	uploader   *operation.Uploader
+	downloader *operation.Downloader
+	lister     *operation.Lister
+	apiServer  *operation.ApiServer
+}
+
+type command struct {
+	usage string
+	run   func(c *cli, args []string) (interface{}, error)
+}
+
+var commands = map[string]command{
+	"put":      {"put <local file> [key]", (*cli).put},
+	"get":      {"get <key> [local file]", (*cli).get},
+	"ls":       {"ls [prefix]", (*cli).ls},
+	"stat":     {"stat <key>...", (*cli).stat},
+	"rm":       {"rm <key>...", (*cli).rm},
+	"cp":       {"cp <from key> <to key>", (*cli).cp},
+	"mv":       {"mv <from key> <to key>", (*cli).mv},
+	"du":       {"du [prefix] [depth]", (*cli).du},
+	"space":    {"space", (*cli).space},
+	"sync":     {"sync [-j concurrency] [-delete] <local dir> [prefix]", (*cli).sync},
+	"download": {"download [-j concurrency] <prefix> [local dir]", (*cli).download},
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: syncdata [-c config | -m multi-cluster config] [-json] [-v] <command> [args]")
+	fmt.Fprintln(os.Stderr, "config is read from $"+operation.QINIU_MULTI_CLUSTER_ENV+" or $"+operation.QINIU_ENV+" if not specified")
+	fmt.Fprintln(os.Stderr, "\ncommands:")
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintln(os.Stderr, "  "+commands[name].usage)
+	}
+	fmt.Fprintln(os.Stderr, "\nflags:")
+	flag.PrintDefaults()
+}
+
+func main() {
+	cf := flag.String("c", "", "single cluster config file")
+	mcf := flag.String("m", "", "multi-cluster config file")
+	jsonOutput := flag.Bool("json", false, "print results as json")
+	verbose := flag.Bool("v", false, "print verbose logs")
+	flag.Usage = usage
+	flag.Parse()
+
+	if !*verbose {
+		logger := kodocli.NewLogger()
+		logger.SetLevel(kodocli.LOG_LEVEL_WARN)
+		operation.SetLogger(logger)
+	}
+
+	args := flag.Args()
+	if len(args) == 0 {
+		usage()
+		os.Exit(exitUsage)
+	}
+	cmd, ok := commands[args[0]]
+	if !ok {
+		fmt.Fprintln(os.Stderr, "unknown command:", args[0])
+		usage()
+		os.Exit(exitUsage)
+	}
+
+	c, err := newCli(*cf, *mcf)
+	if err != nil {
+		exit(*jsonOutput, exitConfig, err)
+	}
+	result, err := cmd.run(c, args[1:])
+	if result != nil {
+		if *jsonOutput {
+			json.NewEncoder(os.Stdout).Encode(result)
+		} else {
+			fmt.Println(result)
+		}
+	}
+	if err == errUsage {
+		fmt.Fprintln(os.Stderr, "usage: syncdata "+cmd.usage)
+		os.Exit(exitUsage)
+	} else if err != nil {
+		exit(*jsonOutput, exitCode(err), err)
+	}
+}
+
+func exit(jsonOutput bool, code int, err error) {
+	if jsonOutput {
+		json.NewEncoder(os.Stderr).Encode(map[string]interface{}{"error": err.Error(), "code": code})
+	} else {
+		fmt.Fprintln(os.Stderr, "error:", err)
+	}
+	os.Exit(code)
+}
+
+func exitCode(err error) int {
+	switch {
+	case err == errNotFound || err == operation.ErrObjectNotFound || httputil.DetectCode(err) == 612:
+		return exitNotFound
+	case err == operation.ErrUndefinedConfig:
+		return exitConfig
+	default:
+		return exitFailure
+	}
+}
+
+func newCli(configFile, multiConfigFile string) (*cli, error) {
+	if configFile != "" && multiConfigFile != "" {
+		return nil, errors.New("-c and -m can not be specified together")
+	}
+	if configFile != "" {
+		config, err := operation.Load(configFile)
+		if err != nil {
+			return nil, err
+		}
+		return &cli{
+			uploader:   operation.NewUploader(config),
+			downloader: operation.NewDownloader(config),
+			lister:     operation.NewLister(config),
+			apiServer:  operation.NewApiServer(config),
+		}, nil
+	}
+	if multiConfigFile != "" {
+		if _, err := operation.LoadMultiClusterConfigs(multiConfigFile); err != nil {
+			return nil, err
+		}
+		os.Setenv(operation.QINIU_MULTI_CLUSTER_ENV, multiConfigFile)
+	}
+	c := cli{
+		uploader:   operation.NewUploaderV2(),
+		downloader: operation.NewDownloaderV2(),
+		lister:     operation.NewListerV2(),
+		apiServer:  operation.NewApiServerV2(),
+	}
+	if c.uploader == nil {
+		return nil, errors.New("no config is specified, use -c, -m or set $" + operation.QINIU_ENV)
+	}
+	return &c, nil
+}
+
+type transferResult struct {
+	Key  string `json:"key"`
+	File string `json:"file"`
+	Size int64  `json:"size"`
+}
+
+func (r *transferResult) String() string {
+	return fmt.Sprintf("%s\t%s\t%d", r.File, r.Key, r.Size)
+}
+
+func (c *cli) put(args []string) (interface{}, error) {
+	if len(args) < 1 || len(args) > 2 {
+		return nil, errUsage
+	}
+	file, key := args[0], args[0]
+	if len(args) == 2 {
+		key = args[1]
+	}
+	info, err := os.Stat(file)
+	if err != nil {
+		return nil, err
+	}
+	if err = c.uploader.Upload(file, key); err != nil {
+		return nil, err
+	}
+	return &transferResult{Key: key, File: file, Size: info.Size()}, nil
+}
+
+func (c *cli) get(args []string) (interface{}, error) {
+	if len(args) < 1 || len(args) > 2 {
+		return nil, errUsage
+	}
+	key, file := args[0], filepath.Base(args[0])
+	if len(args) == 2 {
+		file = args[1]
+	}
+	stats, err := c.lister.ListStatContext(context.Background(), []string{key})
+	if err != nil {
+		return nil, err
+	} else if err = statError(stats[0]); err != nil {
+		return nil, err
+	}
+	// 下载器会从已有文件的末尾续传，所以先下载到同目录下新的临时文件，成功后再替换目标文件，失败时不影响已有文件
+	tmpFile, err := ioutil.TempFile(filepath.Dir(file), "."+filepath.Base(file)+".")
+	if err != nil {
+		return nil, err
+	}
+	tmpPath := tmpFile.Name()
+	tmpFile.Close()
+	defer os.Remove(tmpPath)
+	if err = os.Chmod(tmpPath, 0644); err != nil {
+		return nil, err
+	}
+	f, err := c.downloader.DownloadFile(key, tmpPath)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+	if err = os.Rename(tmpPath, file); err != nil {
+		return nil, err
+	}
+	return &transferResult{Key: key, File: file, Size: info.Size()}, nil
+}
+
+// 对象不存在时返回 errNotFound，其他失败返回带有状态码的错误
+func statError(stat *operation.FileStat) error {
+	switch stat.Code() {
+	case 200:
+		return nil
+	case 612:
+		return errNotFound
+	default:
+		return &rpc.ErrorInfo{Code: stat.Code(), Err: fmt.Sprintf("stat %s failed with code %d", stat.Name, stat.Code())}
+	}
+}
+
+type statResult struct {
+	*operation.FileStat
+	Code int `json:"code"`
+}
+
+type statList []*statResult
+
+func newStatList(stats []*operation.FileStat) statList {
+	list := make(statList, len(stats))
+	for i, stat := range stats {
+		list[i] = &statResult{FileStat: stat, Code: stat.Code()}
+	}
+	return list
+}
+
+func (stats statList) String() string {
+	lines := make([]string, len(stats))
+	for i, stat := range stats {
+		switch stat.Code {
+		case 200:
+			lines[i] = fmt.Sprintf("%s\t%d\t%s", stat.Name, stat.Size, stat.Hash)
+		case 612:
+			lines[i] = stat.Name + "\tnot found"
+		default:
+			lines[i] = fmt.Sprintf("%s\terror code %d", stat.Name, stat.Code)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (c *cli) ls(args []string) (interface{}, error) {
+	if len(args) > 1 {
+		return nil, errUsage
+	}
+	prefix := ""
+	if len(args) == 1 {
+		prefix = args[0]
+	}
+	stats, err := c.lister.ListPrefixStats(context.Background(), prefix)
+	if err != nil {
+		return nil, err
+	}
+	return newStatList(stats), nil
+}
+
+func (c *cli) stat(args []string) (interface{}, error) {
+	if len(args) == 0 {
+		return nil, errUsage
+	}
+	stats, err := c.lister.ListStatContext(context.Background(), args)
+	if err != nil {
+		return nil, err
+	}
+	// 有其他错误时优先返回，全部只是不存在时返回 errNotFound
+	for _, stat := range stats {
+		if err = statError(stat); err != nil && err != errNotFound {
+			return newStatList(stats), err
+		}
+	}
+	for _, stat := range stats {
+		if err = statError(stat); err != nil {
+			return newStatList(stats), err
+		}
+	}
+	return newStatList(stats), nil
+}
+
+type removeResult struct {
+	Key   string `json:"key"`
+	Error string `json:"error,omitempty"`
+}
+
+type removeResults []*removeResult
+
+func (results removeResults) String() string {
+	lines := make([]string, len(results))
+	for i, result := range results {
+		if result.Error != "" {
+			lines[i] = result.Key + "\t" + result.Error
+		} else {
+			lines[i] = result.Key + "\tdeleted"
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (c *cli) rm(args []string) (interface{}, error) {
+	if len(args) == 0 {
+		return nil, errUsage
+	}
+	var (
+		results  = make(removeResults, len(args))
+		firstErr error
+	)
+	for i, key := range args {
+		results[i] = &removeResult{Key: key}
+		if err := c.lister.Delete(key); err != nil {
+			results[i].Error = err.Error()
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return results, firstErr
+}
+
+func (c *cli) cp(args []string) (interface{}, error) {
+	if len(args) != 2 {
+		return nil, errUsage
+	}
+	return nil, c.lister.Copy(args[0], args[1])
+}
+
+func (c *cli) mv(args []string) (interface{}, error) {
+	if len(args) != 2 {
+		return nil, errUsage
+	}
+	return nil, c.lister.Rename(args[0], args[1])
+}
+
+type usageResults []*operation.PrefixUsage
+
+func (results usageResults) String() string {
+	lines := make([]string, len(results))
+	for i, usage := range results {
+		lines[i] = fmt.Sprintf("%d\t%d\t%s", usage.Bytes, usage.Count, usage.Prefix)
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (c *cli) du(args []string) (interface{}, error) {
+	if len(args) > 2 {
+		return nil, errUsage
+	}
+	prefix, depth := "", 0
+	if len(args) >= 1 {
+		prefix = args[0]
+	}
+	if len(args) == 2 {
+		var err error
+		if depth, err = strconv.Atoi(args[1]); err != nil || depth < 0 {
+			return nil, errUsage
+		}
+	}
+	usages, err := c.lister.Usage(context.Background(), prefix, depth)
+	if err != nil {
+		return nil, err
+	}
+	return usageResults(usages), nil
+}
+
+type spaceResults map[string]uint64
+
+func (results spaceResults) String() string {
+	prefixes := make([]string, 0, len(results))
+	for prefix := range results {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Strings(prefixes)
+	lines := make([]string, len(prefixes))
+	for i, prefix := range prefixes {
+		lines[i] = fmt.Sprintf("%d\t%s", results[prefix], prefix)
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (c *cli) space(args []string) (interface{}, error) {
+	if len(args) != 0 {
+		return nil, errUsage
+	}
+	sizes, err := c.apiServer.GetLogicalAvailableSizes()
+	if err != nil {
+		return nil, err
+	}
+	return spaceResults(sizes), nil
+}
+
+// 收到中断信号后取消的 ctx
+func interruptContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		select {
+		case <-interrupt:
+			cancel()
+		case <-ctx.Done():
+		}
+		signal.Stop(interrupt)
+	}()
+	return ctx, cancel
+}
+
+func failedError(failed []*operation.SyncError) error {
+	if len(failed) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%d files failed, first error: %v", len(failed), failed[0])
+}
+
+func failedMessages(failed []*operation.SyncError) []string {
+	errs := make([]string, len(failed))
+	for i, e := range failed {
+		errs[i] = e.Error()
+	}
+	return errs
+}
+
+type syncResult struct {
+	Uploaded      int      `json:"uploaded"`
+	UploadedBytes int64    `json:"uploaded_bytes"`
+	Skipped       int      `json:"skipped"`
+	Deleted       int      `json:"deleted"`
+	Failed        []string `json:"failed,omitempty"`
+}
+
+func (r *syncResult) String() string {
+	lines := make([]string, 0, len(r.Failed)+1)
+	for _, failed := range r.Failed {
+		lines = append(lines, "failed: "+failed)
+	}
+	lines = append(lines, fmt.Sprintf("uploaded: %d (%d bytes), skipped: %d, deleted: %d, failed: %d",
+		r.Uploaded, r.UploadedBytes, r.Skipped, r.Deleted, len(r.Failed)))
+	return strings.Join(lines, "\n")
+}
+
+func (c *cli) sync(args []string) (interface{}, error) {
+	flags := flag.NewFlagSet("sync", flag.ContinueOnError)
+	flags.Usage = func() {}
+	concurrency := flags.Int("j", 4, "upload concurrency")
+	del := flags.Bool("delete", false, "delete remote keys which don't exist locally")
+	if err := flags.Parse(args); err != nil {
+		return nil, errUsage
+	}
+	args = flags.Args()
+	if len(args) < 1 || len(args) > 2 {
+		return nil, errUsage
+	}
+	dir, prefix := args[0], ""
+	if len(args) == 2 {
+		prefix = args[1]
+	}
+
+	ctx, cancel := interruptContext()
+	defer cancel()
+	result, err := operation.SyncDir(ctx, c.uploader, c.lister, dir, prefix,
+		&operation.SyncOptions{Concurrency: *concurrency, Delete: *del})
+	if result == nil {
+		return nil, err
+	}
+	ret := syncResult{Uploaded: result.Uploaded, UploadedBytes: result.UploadedBytes, Skipped: result.Skipped,
+		Deleted: result.Deleted, Failed: failedMessages(result.Failed)}
+	if err == nil {
+		err = failedError(result.Failed)
+	}
+	return &ret, err
+}
+
+type downloadResult struct {
+	Downloaded      int      `json:"downloaded"`
+	DownloadedBytes int64    `json:"downloaded_bytes"`
+	Skipped         int      `json:"skipped"`
+	Failed          []string `json:"failed,omitempty"`
+}
+
+func (r *downloadResult) String() string {
+	lines := make([]string, 0, len(r.Failed)+1)
+	for _, failed := range r.Failed {
+		lines = append(lines, "failed: "+failed)
+	}
+	lines = append(lines, fmt.Sprintf("downloaded: %d (%d bytes), skipped: %d, failed: %d",
+		r.Downloaded, r.DownloadedBytes, r.Skipped, len(r.Failed)))
+	return strings.Join(lines, "\n")
+}
+
+func (c *cli) download(args []string) (interface{}, error) {
+	flags := flag.NewFlagSet("download", flag.ContinueOnError)
+	flags.Usage = func() {}
+	concurrency := flags.Int("j", 4, "download concurrency")
+	if err := flags.Parse(args); err != nil {
+		return nil, errUsage
+	}
+	args = flags.Args()
+	if len(args) < 1 || len(args) > 2 {
+		return nil, errUsage
+	}
+	prefix, dir := args[0], "."
+	if len(args) == 2 {
+		dir = args[1]
+	}
+
+	ctx, cancel := interruptContext()
+	defer cancel()
+	result, err := operation.DownloadPrefix(ctx, c.downloader, c.lister, prefix, dir,
+		&operation.DownloadPrefixOptions{Concurrency: *concurrency})
+	if result == nil {
+		return nil, err
+	}
+	ret := downloadResult{Downloaded: result.Downloaded, DownloadedBytes: result.DownloadedBytes,
+		Skipped: result.Skipped, Failed: failedMessages(result.Failed)}
+	if err == nil {
+		err = failedError(result.Failed)
+	}
+	return &ret, err
+}
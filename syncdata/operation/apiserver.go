@@ -9,7 +9,6 @@ import (
 	"sync"
 	"sync/atomic"
 
-	"github.com/qiniupd/qiniu-go-sdk/api.v7/auth/qbox"
 	"github.com/qiniupd/qiniu-go-sdk/api.v7/kodo"
 )
 
@@ -85,8 +84,6 @@ func (svr *ApiServer) getLogicalAvailableSizeForConfig(ctx context.Context, conf
 }
 
 func newSingleClusterApiServer(c *Config) *singleClusterApiServer {
-	mac := qbox.NewMac(c.Ak, c.Sk)
-
 	var queryer *Queryer = nil
 
 	if len(c.UcHosts) > 0 {
@@ -95,7 +92,7 @@ func newSingleClusterApiServer(c *Config) *singleClusterApiServer {
 
 	svr := singleClusterApiServer{
 		apiServerHosts: dupStrings(c.ApiServerHosts),
-		credentials:    mac,
+		credentials:    c.credentialsProvider(),
 		queryer:        queryer,
 	}
 	shuffleHosts(svr.apiServerHosts)
@@ -104,7 +101,7 @@ func newSingleClusterApiServer(c *Config) *singleClusterApiServer {
 
 type singleClusterApiServer struct {
 	apiServerHosts []string
-	credentials    *qbox.Mac
+	credentials    CredentialsProvider
 	queryer        *Queryer
 }
 
@@ -162,7 +159,11 @@ func (svr *singleClusterApiServer) miscconfigs(ctx context.Context) (mcfgs *misc
 		apiServerHost := svr.nextApiServerHost(failedApiServerHosts)
 		url := fmt.Sprintf("%s/miscconfigs", apiServerHost)
 		var ret miscConfigs
-		if err := svr.newClient(apiServerHost).Call(ctx, &ret, http.MethodGet, url); err != nil {
+		var client *kodo.Client
+		if client, err = svr.newClient(apiServerHost); err != nil {
+			return nil, err
+		}
+		if err = client.Call(ctx, &ret, http.MethodGet, url); err != nil {
 			failedApiServerHosts[apiServerHost] = struct{}{}
 			failHostName(apiServerHost)
 			continue
@@ -185,7 +186,11 @@ func (svr *singleClusterApiServer) scale(ctx context.Context, n, m uint64) (s *s
 		apiServerHost := svr.nextApiServerHost(failedApiServerHosts)
 		url := fmt.Sprintf("%s/tool/scale/n/%d/m/%d", apiServerHost, n, m)
 		var ret scale
-		if err := svr.newClient(apiServerHost).Call(ctx, &ret, http.MethodGet, url); err != nil {
+		var client *kodo.Client
+		if client, err = svr.newClient(apiServerHost); err != nil {
+			return nil, err
+		}
+		if err = client.Call(ctx, &ret, http.MethodGet, url); err != nil {
 			failedApiServerHosts[apiServerHost] = struct{}{}
 			failHostName(apiServerHost)
 			continue
@@ -197,13 +202,17 @@ func (svr *singleClusterApiServer) scale(ctx context.Context, n, m uint64) (s *s
 	return
 }
 
-func (svr *singleClusterApiServer) newClient(host string) *kodo.Client {
+func (svr *singleClusterApiServer) newClient(host string) (*kodo.Client, error) {
+	mac, err := svr.credentials.Get()
+	if err != nil {
+		return nil, err
+	}
 	cfg := kodo.Config{
-		AccessKey: svr.credentials.AccessKey,
-		SecretKey: string(svr.credentials.SecretKey),
+		AccessKey: mac.AccessKey,
+		SecretKey: string(mac.SecretKey),
 		APIHost:   host,
 	}
-	return kodo.NewWithoutZone(&cfg)
+	return kodo.NewWithoutZone(&cfg), nil
 }
 
 func parseWriteModeString(modeString string) (index, replica, n, m uint64, err error) {
@@ -45,10 +45,12 @@ func isHostNameValid(hostName string) bool {
 func failHostName(hostName string) {
 	hs, _ := hostsScores.LoadOrStore(hostName, newHostsScore())
 	hs.(*hostsScore).fail()
+	DefaultMetrics.recordHost(hostName, false)
 }
 
 func succeedHostName(hostName string) {
 	hostsScores.Delete(hostName)
+	DefaultMetrics.recordHost(hostName, true)
 }
 
 func newHostsScore() *hostsScore {
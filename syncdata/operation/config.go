@@ -8,6 +8,7 @@ import (
 	"strings"
 
 	"github.com/pelletier/go-toml"
+	"github.com/qiniupd/qiniu-go-sdk/api.v8/limit"
 )
 
 // 单集群配置文件
@@ -29,13 +30,37 @@ type Config struct {
 	BatchConcurrency int      `json:"batch_concurrency" toml:"batch_concurrency"`
 	BatchSize        int      `json:"batch_size" toml:"batch_size"`
 
+	// 分片上传文件时预读的分片数，为 0 时不预读，内存占用最多为 (UpConcurrency + UpReadAhead) × PartSize
+	UpReadAhead int `json:"up_read_ahead" toml:"up_read_ahead"`
+
 	DownPath string `json:"down_path" toml:"down_path"`
 	Sim      bool   `json:"sim" toml:"sim"`
 
+	ServerToken        string   `json:"server_token" toml:"server_token"`
+	ServerAk           string   `json:"server_ak" toml:"server_ak"`
+	ServerSk           string   `json:"server_sk" toml:"server_sk"`
+	AllowedPaths       []string `json:"allowed_paths" toml:"allowed_paths"`
+	MaxRequestBodySize int64    `json:"max_request_body_size" toml:"max_request_body_size"`
+	TlsCertFile        string   `json:"tls_cert_file" toml:"tls_cert_file"`
+	TlsKeyFile         string   `json:"tls_key_file" toml:"tls_key_file"`
+	JobsPath           string   `json:"jobs_path" toml:"jobs_path"`
+	JobConcurrency     int      `json:"job_concurrency" toml:"job_concurrency"`
+
 	IoHosts []string `json:"io_hosts" toml:"io_hosts"`
 	UcHosts []string `json:"uc_hosts" toml:"uc_hosts"`
 
-	originalPath string `json:"-" toml:"-"`
+	CredentialsFile     string              `json:"credentials_file" toml:"credentials_file"`
+	CredentialsCommand  []string            `json:"credentials_command" toml:"credentials_command"`
+	CredentialsRefresh  int                 `json:"credentials_refresh" toml:"credentials_refresh"`
+	CredentialsProvider CredentialsProvider `json:"-" toml:"-"`
+
+	UpRateLimit   int64 `json:"up_rate_limit" toml:"up_rate_limit"`
+	DownRateLimit int64 `json:"down_rate_limit" toml:"down_rate_limit"`
+
+	originalPath              string              `json:"-" toml:"-"`
+	cachedCredentialsProvider CredentialsProvider `json:"-" toml:"-"`
+	upRateLimiter             *limit.RateLimiter  `json:"-" toml:"-"`
+	downRateLimiter           *limit.RateLimiter  `json:"-" toml:"-"`
 }
 
 func (config *Config) forEachClusterConfig(f func(string, *Config) error) error {
@@ -0,0 +1,224 @@
+package operation
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pelletier/go-toml"
+	"github.com/qiniupd/qiniu-go-sdk/api.v7/auth/qbox"
+)
+
+const (
+	QINIU_ACCESS_KEY_ENV = "QINIU_ACCESS_KEY"
+	QINIU_SECRET_KEY_ENV = "QINIU_SECRET_KEY"
+)
+
+var (
+	ErrEmptyCredentials = errors.New("empty credentials")
+
+	defaultCredentialsRefreshInterval = 5 * time.Minute
+	credentialsCommandTimeout         = 30 * time.Second
+	credentialsProviderLock           sync.Mutex
+)
+
+// 密钥提供者，每次签名请求或生成上传凭证时都会调用，以支持密钥轮换
+type CredentialsProvider interface {
+	Get() (*qbox.Mac, error)
+}
+
+type credentialsData struct {
+	Ak         string    `json:"ak" toml:"ak"`
+	Sk         string    `json:"sk" toml:"sk"`
+	Expiration time.Time `json:"expiration" toml:"expiration"`
+}
+
+func (data *credentialsData) toMac() (*qbox.Mac, error) {
+	if data.Ak == "" || data.Sk == "" {
+		return nil, ErrEmptyCredentials
+	}
+	return &qbox.Mac{AccessKey: data.Ak, SecretKey: []byte(data.Sk)}, nil
+}
+
+// 固定密钥提供者
+type StaticCredentialsProvider struct {
+	mac *qbox.Mac
+}
+
+// 根据固定的 AK / SK 创建密钥提供者
+func NewStaticCredentialsProvider(ak, sk string) *StaticCredentialsProvider {
+	return &StaticCredentialsProvider{mac: qbox.NewMac(ak, sk)}
+}
+
+func (provider *StaticCredentialsProvider) Get() (*qbox.Mac, error) {
+	return provider.mac, nil
+}
+
+// 环境变量密钥提供者，每次调用都重新读取 QINIU_ACCESS_KEY 和 QINIU_SECRET_KEY
+type EnvCredentialsProvider struct{}
+
+// 创建环境变量密钥提供者
+func NewEnvCredentialsProvider() *EnvCredentialsProvider {
+	return &EnvCredentialsProvider{}
+}
+
+func (provider *EnvCredentialsProvider) Get() (*qbox.Mac, error) {
+	data := credentialsData{Ak: os.Getenv(QINIU_ACCESS_KEY_ENV), Sk: os.Getenv(QINIU_SECRET_KEY_ENV)}
+	return data.toMac()
+}
+
+// 文件密钥提供者，文件内容为包含 ak 和 sk 的 JSON 或 TOML，文件修改后自动重新加载
+type FileCredentialsProvider struct {
+	path    string
+	lock    sync.Mutex
+	mac     *qbox.Mac
+	modTime time.Time
+	size    int64
+}
+
+// 根据密钥文件路径创建密钥提供者
+func NewFileCredentialsProvider(path string) *FileCredentialsProvider {
+	return &FileCredentialsProvider{path: path}
+}
+
+func (provider *FileCredentialsProvider) Get() (*qbox.Mac, error) {
+	provider.lock.Lock()
+	defer provider.lock.Unlock()
+
+	fileInfo, err := os.Stat(provider.path)
+	if err != nil {
+		if provider.mac != nil {
+			elog.Warn("stat credentials file failed, use the last loaded credentials:", provider.path, err)
+			return provider.mac, nil
+		}
+		return nil, err
+	}
+	if provider.mac != nil && fileInfo.ModTime().Equal(provider.modTime) && fileInfo.Size() == provider.size {
+		return provider.mac, nil
+	}
+
+	raw, err := ioutil.ReadFile(provider.path)
+	if err != nil {
+		return nil, err
+	}
+	var data credentialsData
+	if strings.ToLower(path.Ext(provider.path)) == ".toml" {
+		err = toml.Unmarshal(raw, &data)
+	} else {
+		err = json.Unmarshal(raw, &data)
+	}
+	if err != nil {
+		return nil, err
+	}
+	mac, err := data.toMac()
+	if err != nil {
+		return nil, err
+	}
+	if provider.mac != nil && provider.mac.AccessKey != mac.AccessKey {
+		elog.Info("credentials reloaded from file:", provider.path, mac.AccessKey)
+	}
+	provider.mac = mac
+	provider.modTime = fileInfo.ModTime()
+	provider.size = fileInfo.Size()
+	return mac, nil
+}
+
+// 命令密钥提供者，执行外部命令（例如读取 Vault）获取密钥，命令需要向标准输出打印包含 ak、sk 以及可选的 expiration 的 JSON
+type CommandCredentialsProvider struct {
+	command         []string
+	refreshInterval time.Duration
+	lock            sync.Mutex
+	mac             *qbox.Mac
+	expiredAt       time.Time
+}
+
+// 根据命令及刷新间隔创建密钥提供者，refreshInterval 为 0 时使用默认的 5 分钟
+func NewCommandCredentialsProvider(command []string, refreshInterval time.Duration) *CommandCredentialsProvider {
+	if refreshInterval <= 0 {
+		refreshInterval = defaultCredentialsRefreshInterval
+	}
+	return &CommandCredentialsProvider{command: command, refreshInterval: refreshInterval}
+}
+
+func (provider *CommandCredentialsProvider) Get() (*qbox.Mac, error) {
+	provider.lock.Lock()
+	defer provider.lock.Unlock()
+
+	if provider.mac != nil && time.Now().Before(provider.expiredAt) {
+		return provider.mac, nil
+	}
+	// 命令执行失败或者输出的密钥无效时都继续使用上一次获取的密钥
+	var mac *qbox.Mac
+	data, err := provider.execute()
+	if err == nil {
+		mac, err = data.toMac()
+	}
+	if err != nil {
+		if provider.mac != nil {
+			elog.Warn("refresh credentials by command failed, use the last credentials:", err)
+			return provider.mac, nil
+		}
+		return nil, err
+	}
+	provider.mac = mac
+	provider.expiredAt = time.Now().Add(provider.refreshInterval)
+	if !data.Expiration.IsZero() && data.Expiration.Before(provider.expiredAt) {
+		provider.expiredAt = data.Expiration
+	}
+	return mac, nil
+}
+
+func (provider *CommandCredentialsProvider) execute() (*credentialsData, error) {
+	if len(provider.command) == 0 {
+		return nil, errors.New("empty credentials command")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), credentialsCommandTimeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, provider.command[0], provider.command[1:]...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, errors.New("execute credentials command failed: " + err.Error() + ": " + strings.TrimSpace(stderr.String()))
+	}
+	var data credentialsData
+	if err := json.Unmarshal(stdout.Bytes(), &data); err != nil {
+		return nil, err
+	}
+	return &data, nil
+}
+
+// 获取配置对应的密钥提供者
+// 优先使用 CredentialsProvider，其次依次是 credentials_command，credentials_file，未配置 ak 时使用环境变量，否则使用 ak / sk
+func (config *Config) credentialsProvider() CredentialsProvider {
+	if config.CredentialsProvider != nil {
+		return config.CredentialsProvider
+	}
+
+	credentialsProviderLock.Lock()
+	defer credentialsProviderLock.Unlock()
+	if config.cachedCredentialsProvider != nil {
+		return config.cachedCredentialsProvider
+	}
+	var provider CredentialsProvider
+	if len(config.CredentialsCommand) > 0 {
+		provider = NewCommandCredentialsProvider(config.CredentialsCommand, time.Duration(config.CredentialsRefresh)*time.Second)
+	} else if config.CredentialsFile != "" {
+		provider = NewFileCredentialsProvider(config.CredentialsFile)
+	} else if config.Ak == "" && os.Getenv(QINIU_ACCESS_KEY_ENV) != "" {
+		provider = NewEnvCredentialsProvider()
+	} else {
+		provider = NewStaticCredentialsProvider(config.Ak, config.Sk)
+	}
+	config.cachedCredentialsProvider = provider
+	return provider
+}
@@ -0,0 +1,79 @@
+package operation
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileCredentialsProvider(t *testing.T) {
+	dirPath, err := ioutil.TempDir("", "credentials")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dirPath)
+
+	credentialsPath := filepath.Join(dirPath, "credentials.json")
+	err = ioutil.WriteFile(credentialsPath, []byte(`{"ak": "ak-1", "sk": "sk-1"}`), 0600)
+	assert.NoError(t, err)
+
+	provider := NewFileCredentialsProvider(credentialsPath)
+	mac, err := provider.Get()
+	assert.NoError(t, err)
+	assert.Equal(t, mac.AccessKey, "ak-1")
+	assert.Equal(t, string(mac.SecretKey), "sk-1")
+
+	err = ioutil.WriteFile(credentialsPath, []byte(`{"ak": "ak-22", "sk": "sk-22"}`), 0600)
+	assert.NoError(t, err)
+	mac, err = provider.Get()
+	assert.NoError(t, err)
+	assert.Equal(t, mac.AccessKey, "ak-22")
+	assert.Equal(t, string(mac.SecretKey), "sk-22")
+
+	os.Remove(credentialsPath)
+	mac, err = provider.Get()
+	assert.NoError(t, err)
+	assert.Equal(t, mac.AccessKey, "ak-22")
+}
+
+func TestCommandCredentialsProvider(t *testing.T) {
+	provider := NewCommandCredentialsProvider([]string{"echo", `{"ak": "ak-1", "sk": "sk-1"}`}, time.Minute)
+	mac, err := provider.Get()
+	assert.NoError(t, err)
+	assert.Equal(t, mac.AccessKey, "ak-1")
+	assert.Equal(t, string(mac.SecretKey), "sk-1")
+
+	// 刷新时命令失败或者输出无效的密钥，继续使用上一次的密钥
+	for _, command := range [][]string{{"false"}, {"echo", `{}`}, {"echo", "invalid"}} {
+		provider.command = command
+		provider.expiredAt = time.Time{}
+		mac, err = provider.Get()
+		assert.NoError(t, err)
+		assert.Equal(t, mac.AccessKey, "ak-1")
+	}
+
+	_, err = NewCommandCredentialsProvider([]string{"false"}, time.Minute).Get()
+	assert.Error(t, err)
+	_, err = NewCommandCredentialsProvider([]string{"echo", `{}`}, time.Minute).Get()
+	assert.Error(t, err)
+}
+
+func TestConfigCredentialsProvider(t *testing.T) {
+	os.Setenv(QINIU_ACCESS_KEY_ENV, "ak-env")
+	os.Setenv(QINIU_SECRET_KEY_ENV, "sk-env")
+	defer os.Unsetenv(QINIU_ACCESS_KEY_ENV)
+	defer os.Unsetenv(QINIU_SECRET_KEY_ENV)
+
+	config := Config{}
+	mac, err := config.credentialsProvider().Get()
+	assert.NoError(t, err)
+	assert.Equal(t, mac.AccessKey, "ak-env")
+
+	config = Config{Ak: "ak-1", Sk: "sk-1"}
+	mac, err = config.credentialsProvider().Get()
+	assert.NoError(t, err)
+	assert.Equal(t, mac.AccessKey, "ak-1")
+	assert.Same(t, config.credentialsProvider(), config.credentialsProvider())
+}
@@ -1,6 +1,7 @@
 package operation
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -13,10 +14,12 @@ import (
 	"sync/atomic"
 	"time"
 
-	"github.com/qiniupd/qiniu-go-sdk/api.v7/auth/qbox"
+	"github.com/qiniupd/qiniu-go-sdk/api.v8/limit"
 	"github.com/qiniupd/qiniu-go-sdk/x/rpc.v7"
 )
 
+var ErrObjectNotFound = errors.New("object not found")
+
 var downloadClient = &http.Client{
 	Transport: &http.Transport{
 		Proxy: http.ProxyFromEnvironment,
@@ -92,16 +95,28 @@ func (d *Downloader) DownloadRangeBytes(key string, offset, size int64) (l int64
 	}
 }
 
+// 下载指定对象从 offset 开始的 size 个字节，返回对象总长度和数据流，size 小于等于 0 表示读取到对象末尾
+// 调用方需要关闭返回的数据流
+func (d *Downloader) DownloadRangeReader(key string, offset, size int64) (l int64, reader io.ReadCloser, err error) {
+	if d.singleClusterDownloader != nil {
+		return d.singleClusterDownloader.downloadRangeReader(key, offset, size)
+	}
+	if config, exists := d.config.forKey(key); !exists {
+		return 0, nil, ErrUndefinedConfig
+	} else {
+		return newSingleClusterDownloader(config).downloadRangeReader(key, offset, size)
+	}
+}
+
 type singleClusterDownloader struct {
-	bucket      string
-	ioHosts     []string
-	credentials *qbox.Mac
-	queryer     *Queryer
+	bucket       string
+	ioHosts      []string
+	credentials  CredentialsProvider
+	queryer      *Queryer
+	rateLimiters []*limit.RateLimiter
 }
 
 func newSingleClusterDownloader(c *Config) *singleClusterDownloader {
-	mac := qbox.NewMac(c.Ak, c.Sk)
-
 	var queryer *Queryer = nil
 
 	if len(c.UcHosts) > 0 {
@@ -109,18 +124,24 @@ func newSingleClusterDownloader(c *Config) *singleClusterDownloader {
 	}
 
 	downloader := singleClusterDownloader{
-		bucket:      c.Bucket,
-		ioHosts:     dupStrings(c.IoHosts),
-		credentials: mac,
-		queryer:     queryer,
+		bucket:       c.Bucket,
+		ioHosts:      dupStrings(c.IoHosts),
+		credentials:  c.credentialsProvider(),
+		queryer:      queryer,
+		rateLimiters: []*limit.RateLimiter{GlobalDownRateLimiter, c.DownRateLimiter()},
 	}
 	shuffleHosts(downloader.ioHosts)
 	return &downloader
 }
 
 func (d *singleClusterDownloader) downloadFile(key, path string) (f *os.File, err error) {
+	t := time.Now()
+	defer func() { DefaultMetrics.recordOperation("download_file", t, err) }()
 	failedIoHosts := make(map[string]struct{})
 	for i := 0; i < 3; i++ {
+		if i > 0 {
+			DefaultMetrics.recordRetry("download_file")
+		}
 		f, err = d.downloadFileInner(key, path, failedIoHosts)
 		if err == nil {
 			return
@@ -130,8 +151,13 @@ func (d *singleClusterDownloader) downloadFile(key, path string) (f *os.File, er
 }
 
 func (d *singleClusterDownloader) downloadBytes(key string) (data []byte, err error) {
+	t := time.Now()
+	defer func() { DefaultMetrics.recordOperation("download_bytes", t, err) }()
 	failedIoHosts := make(map[string]struct{})
 	for i := 0; i < 3; i++ {
+		if i > 0 {
+			DefaultMetrics.recordRetry("download_bytes")
+		}
 		data, err = d.downloadBytesInner(key, failedIoHosts)
 		if err == nil {
 			break
@@ -141,8 +167,13 @@ func (d *singleClusterDownloader) downloadBytes(key string) (data []byte, err er
 }
 
 func (d *singleClusterDownloader) downloadRangeBytes(key string, offset, size int64) (l int64, data []byte, err error) {
+	t := time.Now()
+	defer func() { DefaultMetrics.recordOperation("download_range", t, err) }()
 	failedIoHosts := make(map[string]struct{})
 	for i := 0; i < 3; i++ {
+		if i > 0 {
+			DefaultMetrics.recordRetry("download_range")
+		}
 		l, data, err = d.downloadRangeBytesInner(key, offset, size, failedIoHosts)
 		if err == nil {
 			break
@@ -151,6 +182,22 @@ func (d *singleClusterDownloader) downloadRangeBytes(key string, offset, size in
 	return
 }
 
+func (d *singleClusterDownloader) downloadRangeReader(key string, offset, size int64) (l int64, reader io.ReadCloser, err error) {
+	t := time.Now()
+	defer func() { DefaultMetrics.recordOperation("download_range", t, err) }()
+	failedIoHosts := make(map[string]struct{})
+	for i := 0; i < 3; i++ {
+		if i > 0 {
+			DefaultMetrics.recordRetry("download_range")
+		}
+		l, reader, err = d.downloadRangeReaderInner(key, offset, size, failedIoHosts)
+		if err == nil || err == ErrObjectNotFound {
+			break
+		}
+	}
+	return
+}
+
 var curIoHostIndex uint32 = 0
 
 func (d *singleClusterDownloader) nextHost(failedHosts map[string]struct{}) string {
@@ -179,20 +226,29 @@ func (d *singleClusterDownloader) nextHost(failedHosts map[string]struct{}) stri
 	}
 }
 
-func (d *singleClusterDownloader) downloadFileInner(key, path string, failedIoHosts map[string]struct{}) (*os.File, error) {
+func (d *singleClusterDownloader) downloadFileInner(key, path string, failedIoHosts map[string]struct{}) (_ *os.File, err error) {
 	key = strings.TrimPrefix(key, "/")
 	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
 	if err != nil {
 		return nil, err
 	}
+	defer func() {
+		if err != nil {
+			f.Close()
+		}
+	}()
 	length, err := f.Seek(0, io.SeekEnd)
 	if err != nil {
 		return nil, err
 	}
+	mac, err := d.credentials.Get()
+	if err != nil {
+		return nil, err
+	}
 	host := d.nextHost(failedIoHosts)
 
-	fmt.Println("remote path", key)
-	url := fmt.Sprintf("%s/getfile/%s/%s/%s", host, d.credentials.AccessKey, d.bucket, key)
+	elog.Info("remote path", key)
+	url := fmt.Sprintf("%s/getfile/%s/%s/%s", host, mac.AccessKey, d.bucket, key)
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
 		failedIoHosts[host] = struct{}{}
@@ -204,7 +260,7 @@ func (d *singleClusterDownloader) downloadFileInner(key, path string, failedIoHo
 	if length != 0 {
 		r := fmt.Sprintf("bytes=%d-", length)
 		req.Header.Set("Range", r)
-		fmt.Println("continue download")
+		elog.Info("continue download")
 	}
 
 	response, err := downloadClient.Do(req)
@@ -225,7 +281,8 @@ func (d *singleClusterDownloader) downloadFileInner(key, path string, failedIoHo
 	}
 	succeedHostName(host)
 	ctLength := response.ContentLength
-	n, err := io.Copy(f, response.Body)
+	n, err := io.Copy(limit.NewRateLimitedWriter(context.Background(), f, d.rateLimiters...), response.Body)
+	DefaultMetrics.recordBytes("download_file", host, n)
 	if err != nil {
 		return nil, err
 	}
@@ -238,9 +295,13 @@ func (d *singleClusterDownloader) downloadFileInner(key, path string, failedIoHo
 
 func (d *singleClusterDownloader) downloadBytesInner(key string, failedIoHosts map[string]struct{}) ([]byte, error) {
 	key = strings.TrimPrefix(key, "/")
+	mac, err := d.credentials.Get()
+	if err != nil {
+		return nil, err
+	}
 	host := d.nextHost(failedIoHosts)
 
-	url := fmt.Sprintf("%s/getfile/%s/%s/%s", host, d.credentials.AccessKey, d.bucket, key)
+	url := fmt.Sprintf("%s/getfile/%s/%s/%s", host, mac.AccessKey, d.bucket, key)
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
 		return nil, err
@@ -260,7 +321,9 @@ func (d *singleClusterDownloader) downloadBytesInner(key string, failedIoHosts m
 		return nil, errors.New(response.Status)
 	}
 	succeedHostName(host)
-	return ioutil.ReadAll(response.Body)
+	data, err := ioutil.ReadAll(d.withRateLimit(response.Body))
+	DefaultMetrics.recordBytes("download_bytes", host, int64(len(data)))
+	return data, err
 }
 
 func generateRange(offset, size int64) string {
@@ -272,9 +335,13 @@ func generateRange(offset, size int64) string {
 
 func (d *singleClusterDownloader) downloadRangeBytesInner(key string, offset, size int64, failedIoHosts map[string]struct{}) (int64, []byte, error) {
 	key = strings.TrimPrefix(key, "/")
+	mac, err := d.credentials.Get()
+	if err != nil {
+		return -1, nil, err
+	}
 	host := d.nextHost(failedIoHosts)
 
-	url := fmt.Sprintf("%s/getfile/%s/%s/%s", host, d.credentials.AccessKey, d.bucket, key)
+	url := fmt.Sprintf("%s/getfile/%s/%s/%s", host, mac.AccessKey, d.bucket, key)
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
 		failedIoHosts[host] = struct{}{}
@@ -311,7 +378,8 @@ func (d *singleClusterDownloader) downloadRangeBytesInner(key string, offset, si
 		failHostName(host)
 		return -1, nil, err
 	}
-	b, err := ioutil.ReadAll(response.Body)
+	b, err := ioutil.ReadAll(d.withRateLimit(response.Body))
+	DefaultMetrics.recordBytes("download_range", host, int64(len(b)))
 	if err != nil {
 		failedIoHosts[host] = struct{}{}
 		failHostName(host)
@@ -321,6 +389,79 @@ func (d *singleClusterDownloader) downloadRangeBytesInner(key string, offset, si
 	return l, b, err
 }
 
+func (d *singleClusterDownloader) downloadRangeReaderInner(key string, offset, size int64, failedIoHosts map[string]struct{}) (int64, io.ReadCloser, error) {
+	key = strings.TrimPrefix(key, "/")
+	mac, err := d.credentials.Get()
+	if err != nil {
+		return -1, nil, err
+	}
+	host := d.nextHost(failedIoHosts)
+
+	url := fmt.Sprintf("%s/getfile/%s/%s/%s", host, mac.AccessKey, d.bucket, key)
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return -1, nil, err
+	}
+	if size > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+size-1))
+	} else {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	req.Header.Set("Accept-Encoding", "")
+	req.Header.Set("User-Agent", rpc.UserAgent)
+	response, err := downloadClient.Do(req)
+	if err != nil {
+		failedIoHosts[host] = struct{}{}
+		failHostName(host)
+		return -1, nil, err
+	}
+
+	switch response.StatusCode {
+	case http.StatusOK:
+		succeedHostName(host)
+		if offset == 0 {
+			return response.ContentLength, &meteredReadCloser{ReadCloser: d.withRateLimitCloser(response.Body), operation: "download_range", host: host}, nil
+		}
+		response.Body.Close()
+		return -1, nil, errors.New("range is not supported")
+	case http.StatusPartialContent, http.StatusRequestedRangeNotSatisfiable:
+		succeedHostName(host)
+		l, err := getTotalLength(response.Header.Get("Content-Range"))
+		if err != nil {
+			response.Body.Close()
+			return -1, nil, err
+		}
+		if response.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+			response.Body.Close()
+			if offset < l {
+				return -1, nil, errors.New(response.Status)
+			}
+			return l, ioutil.NopCloser(strings.NewReader("")), nil
+		}
+		return l, &meteredReadCloser{ReadCloser: d.withRateLimitCloser(response.Body), operation: "download_range", host: host}, nil
+	case http.StatusNotFound:
+		succeedHostName(host)
+		response.Body.Close()
+		return -1, nil, ErrObjectNotFound
+	default:
+		failedIoHosts[host] = struct{}{}
+		failHostName(host)
+		response.Body.Close()
+		return -1, nil, errors.New(response.Status)
+	}
+}
+
+func (d *singleClusterDownloader) withRateLimit(r io.Reader) io.Reader {
+	return limit.NewRateLimitedReader(context.Background(), r, d.rateLimiters...)
+}
+
+func (d *singleClusterDownloader) withRateLimitCloser(rc io.ReadCloser) io.ReadCloser {
+	return struct {
+		io.Reader
+		io.Closer
+	}{d.withRateLimit(rc), rc}
+}
+
 func getTotalLength(crange string) (int64, error) {
 	cr := strings.Split(crange, "/")
 	if len(cr) != 2 {
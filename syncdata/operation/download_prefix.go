@@ -0,0 +1,151 @@
+package operation
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	q "github.com/qiniupd/qiniu-go-sdk/api.v8/kodocli"
+)
+
+const defaultDownloadPrefixConcurrency = 4
+
+var errKeyOutOfDir = errors.New("key is out of the local directory")
+
+// 前缀下载选项
+type DownloadPrefixOptions struct {
+	// 并发下载的对象数，默认为 4
+	Concurrency int
+}
+
+// 前缀下载结果
+type DownloadPrefixResult struct {
+	Downloaded      int
+	DownloadedBytes int64
+	Skipped         int
+	Failed          []*SyncError
+}
+
+func (r *DownloadPrefixResult) String() string {
+	return fmt.Sprintf("downloaded: %d (%d bytes), skipped: %d, failed: %d",
+		r.Downloaded, r.DownloadedBytes, r.Skipped, len(r.Failed))
+}
+
+// 将存储空间指定前缀下的所有对象下载到本地目录，对象名去掉前缀后按 / 划分为目录层级
+// 本地文件大小和 etag 与远端一致时跳过下载，本地文件比远端小时视为上次未下载完成，从断点处继续下载
+// 单个对象失败不会中断下载，失败的对象记录在结果中
+func DownloadPrefix(ctx context.Context, downloader *Downloader, lister *Lister, prefix, dir string, options *DownloadPrefixOptions) (*DownloadPrefixResult, error) {
+	if options == nil {
+		options = &DownloadPrefixOptions{}
+	}
+	concurrency := options.Concurrency
+	if concurrency <= 0 {
+		concurrency = defaultDownloadPrefixConcurrency
+	}
+
+	stats, err := lister.listPrefixStats(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		result     DownloadPrefixResult
+		resultLock sync.Mutex
+		pool       = newGoroutinePool(concurrency)
+	)
+	for _, stat := range stats {
+		if strings.HasSuffix(stat.Name, "/") {
+			continue
+		}
+		func(stat *FileStat) {
+			pool.Go(func(ctx context.Context) error {
+				downloaded, err := downloadPrefixObject(ctx, downloader, stat, prefix, dir)
+				resultLock.Lock()
+				defer resultLock.Unlock()
+				if err != nil {
+					elog.Warn("download failed:", stat.Name, err)
+					result.Failed = append(result.Failed, &SyncError{Key: stat.Name, Err: err})
+				} else if downloaded < 0 {
+					result.Skipped++
+				} else {
+					result.Downloaded++
+					result.DownloadedBytes += downloaded
+				}
+				return nil
+			})
+		}(stat)
+	}
+	if err = pool.Wait(ctx); err != nil {
+		return &result, err
+	}
+	return &result, ctx.Err()
+}
+
+// 下载单个对象，返回本次下载的字节数，跳过时返回 -1
+func downloadPrefixObject(ctx context.Context, downloader *Downloader, stat *FileStat, prefix, dir string) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	path, err := keyToLocalPath(dir, prefix, stat.Name)
+	if err != nil {
+		return 0, err
+	}
+	var offset int64
+	if info, err := os.Stat(path); err == nil {
+		if !info.Mode().IsRegular() {
+			return 0, fmt.Errorf("%s is not a regular file", path)
+		}
+		offset = info.Size()
+		if offset == stat.Size {
+			if etag, err := q.GetFileEtag(path); err != nil {
+				return 0, err
+			} else if etag == stat.Hash {
+				return -1, nil
+			}
+		}
+		if offset >= stat.Size {
+			if err = os.Truncate(path, 0); err != nil {
+				return 0, err
+			}
+			offset = 0
+		}
+	} else if os.IsNotExist(err) {
+		if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return 0, err
+		}
+	} else {
+		return 0, err
+	}
+
+	f, err := downloader.DownloadFile(stat.Name, path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if info.Size() != stat.Size {
+		// 断点续传的数据可能已经失效，删除后由下次下载重新开始
+		os.Remove(path)
+		return 0, fmt.Errorf("downloaded size %d is not equal to object size %d", info.Size(), stat.Size)
+	}
+	return stat.Size - offset, nil
+}
+
+// 将对象名转换为本地路径，对象名中的 / 对应目录层级，不允许通过 .. 逃逸出本地目录
+func keyToLocalPath(dir, prefix, key string) (string, error) {
+	rel := filepath.FromSlash(strings.TrimPrefix(key, prefix))
+	path := filepath.Join(dir, rel)
+	if r, err := filepath.Rel(dir, path); err != nil {
+		return "", err
+	} else if r == "." || r == ".." || strings.HasPrefix(r, ".."+string(filepath.Separator)) {
+		return "", errKeyOutOfDir
+	}
+	return path, nil
+}
@@ -0,0 +1,36 @@
+package operation
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeyToLocalPath(t *testing.T) {
+	path, err := keyToLocalPath("/data", "prefix/", "prefix/a/b/c.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, path, filepath.Join("/data", "a", "b", "c.txt"))
+
+	_, err = keyToLocalPath("/data", "prefix/", "prefix/../../etc/passwd")
+	assert.Equal(t, err, errKeyOutOfDir)
+	_, err = keyToLocalPath("/data", "prefix/", "prefix/")
+	assert.Equal(t, err, errKeyOutOfDir)
+}
+
+func TestDownloadPrefixObjectSkip(t *testing.T) {
+	dirPath, err := ioutil.TempDir("", "download")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dirPath)
+
+	assert.NoError(t, os.MkdirAll(filepath.Join(dirPath, "a"), 0755))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dirPath, "a", "1.txt"), []byte("etag"), 0644))
+
+	downloaded, err := downloadPrefixObject(context.Background(), nil,
+		&FileStat{Name: "prefix/a/1.txt", Size: 4, Hash: "FpLiADEaVoALPkdb8tJEJyRTXoe_"}, "prefix/", dirPath)
+	assert.NoError(t, err)
+	assert.Equal(t, downloaded, int64(-1))
+}
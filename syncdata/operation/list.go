@@ -4,15 +4,14 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
-	"fmt"
 	"io"
 	"os"
 	"sort"
 	"strconv"
 	"sync"
 	"sync/atomic"
+	"time"
 
-	"github.com/qiniupd/qiniu-go-sdk/api.v7/auth/qbox"
 	"github.com/qiniupd/qiniu-go-sdk/api.v7/kodo"
 )
 
@@ -58,9 +57,15 @@ func NewListerV2() *Lister {
 type FileStat struct {
 	Name string `json:"name"`
 	Size int64  `json:"size"`
+	Hash string `json:"hash,omitempty"`
 	code int    `json:"-"`
 }
 
+// 获取元信息时服务端返回的状态码，200 表示成功，612 表示对象不存在
+func (stat *FileStat) Code() int {
+	return stat.code
+}
+
 // 重命名对象
 func (l *Lister) Rename(fromKey, toKey string) error {
 	var scl *singleClusterLister
@@ -139,14 +144,19 @@ func (l *Lister) Delete(key string) error {
 // 获取指定对象列表的元信息
 func (l *Lister) ListStat(keys []string) []*FileStat {
 	if fileStats, err := l.listStat(context.Background(), keys); err != nil {
-		fmt.Printf("ListStat: %s", err)
+		elog.Warn("ListStat:", err)
 		return []*FileStat{}
 	} else {
-		fmt.Printf("fileStats: %+v len: %d", fileStats, len(fileStats))
+		elog.Debug("fileStats:", fileStats, "len:", len(fileStats))
 		return fileStats
 	}
 }
 
+// 获取指定对象列表的元信息，对象不存在时 Size 为 -1
+func (l *Lister) ListStatContext(ctx context.Context, keys []string) ([]*FileStat, error) {
+	return l.listStat(ctx, keys)
+}
+
 func (l *Lister) listStat(ctx context.Context, keys []string) ([]*FileStat, error) {
 	if l.singleClusterLister != nil {
 		return l.singleClusterLister.listStat(ctx, keys)
@@ -237,9 +247,38 @@ func (l *Lister) listPrefixForConfig(ctx context.Context, config *Config, prefix
 	return newSingleClusterLister(config).listPrefix(ctx, prefix)
 }
 
-func newSingleClusterLister(c *Config) *singleClusterLister {
-	mac := qbox.NewMac(c.Ak, c.Sk)
+// 根据前缀列举存储空间，返回对象的元信息
+func (l *Lister) ListPrefixStats(ctx context.Context, prefix string) ([]*FileStat, error) {
+	return l.listPrefixStats(ctx, prefix)
+}
+
+func (l *Lister) listPrefixStats(ctx context.Context, prefix string) ([]*FileStat, error) {
+	if l.singleClusterLister != nil {
+		return l.singleClusterLister.listPrefixStats(ctx, prefix)
+	}
 
+	pool := newGoroutinePool(l.multiClustersConcurrency)
+	allStats := make([]*FileStat, 0)
+	var allStatsMutex sync.Mutex
+	l.config.forEachClusterConfig(func(_ string, config *Config) error {
+		pool.Go(func(ctx context.Context) error {
+			if stats, err := newSingleClusterLister(config).listPrefixStats(ctx, prefix); err != nil {
+				return err
+			} else {
+				allStatsMutex.Lock()
+				allStats = append(allStats, stats...)
+				allStatsMutex.Unlock()
+				return nil
+			}
+		})
+		return nil
+	})
+	err := pool.Wait(ctx)
+	sort.Slice(allStats, func(i, j int) bool { return allStats[i].Name < allStats[j].Name })
+	return allStats, err
+}
+
+func newSingleClusterLister(c *Config) *singleClusterLister {
 	var queryer *Queryer = nil
 
 	if len(c.UcHosts) > 0 {
@@ -251,7 +290,7 @@ func newSingleClusterLister(c *Config) *singleClusterLister {
 		rsHosts:          dupStrings(c.RsHosts),
 		upHosts:          dupStrings(c.UpHosts),
 		rsfHosts:         dupStrings(c.RsfHosts),
-		credentials:      mac,
+		credentials:      c.credentialsProvider(),
 		queryer:          queryer,
 		batchConcurrency: c.BatchConcurrency,
 		batchSize:        c.BatchSize,
@@ -273,7 +312,7 @@ type singleClusterLister struct {
 	rsHosts          []string
 	upHosts          []string
 	rsfHosts         []string
-	credentials      *qbox.Mac
+	credentials      CredentialsProvider
 	queryer          *Queryer
 	batchSize        int
 	batchConcurrency int
@@ -335,17 +374,25 @@ func (l *singleClusterLister) nextRsfHost(failedHosts map[string]struct{}) strin
 	}
 }
 
-func (l *singleClusterLister) rename(fromKey, toKey string) error {
+func (l *singleClusterLister) rename(fromKey, toKey string) (err error) {
+	t := time.Now()
+	defer func() { DefaultMetrics.recordOperation("rename", t, err) }()
 	failedRsHosts := make(map[string]struct{})
 	host := l.nextRsHost(failedRsHosts)
-	bucket := l.newBucket(host, "")
-	err := bucket.Move(nil, fromKey, toKey)
+	bucket, err := l.newBucket(host, "")
+	if err != nil {
+		return err
+	}
+	err = bucket.Move(nil, fromKey, toKey)
 	if err != nil {
 		failedRsHosts[host] = struct{}{}
 		failHostName(host)
 		elog.Info("rename retry 0", host, err)
+		DefaultMetrics.recordRetry("rename")
 		host = l.nextRsHost(failedRsHosts)
-		bucket = l.newBucket(host, "")
+		if bucket, err = l.newBucket(host, ""); err != nil {
+			return err
+		}
 		err = bucket.Move(nil, fromKey, toKey)
 		if err != nil {
 			failedRsHosts[host] = struct{}{}
@@ -361,17 +408,25 @@ func (l *singleClusterLister) rename(fromKey, toKey string) error {
 	return nil
 }
 
-func (l *singleClusterLister) moveTo(fromKey, toBucket, toKey string) error {
+func (l *singleClusterLister) moveTo(fromKey, toBucket, toKey string) (err error) {
+	t := time.Now()
+	defer func() { DefaultMetrics.recordOperation("move", t, err) }()
 	failedRsHosts := make(map[string]struct{})
 	host := l.nextRsHost(failedRsHosts)
-	bucket := l.newBucket(host, "")
-	err := bucket.MoveEx(nil, fromKey, toBucket, toKey)
+	bucket, err := l.newBucket(host, "")
+	if err != nil {
+		return err
+	}
+	err = bucket.MoveEx(nil, fromKey, toBucket, toKey)
 	if err != nil {
 		failedRsHosts[host] = struct{}{}
 		failHostName(host)
 		elog.Info("move retry 0", host, err)
+		DefaultMetrics.recordRetry("move")
 		host = l.nextRsHost(failedRsHosts)
-		bucket = l.newBucket(host, "")
+		if bucket, err = l.newBucket(host, ""); err != nil {
+			return err
+		}
 		err = bucket.MoveEx(nil, fromKey, toBucket, toKey)
 		if err != nil {
 			failedRsHosts[host] = struct{}{}
@@ -387,17 +442,25 @@ func (l *singleClusterLister) moveTo(fromKey, toBucket, toKey string) error {
 	return nil
 }
 
-func (l *singleClusterLister) copy(fromKey, toKey string) error {
+func (l *singleClusterLister) copy(fromKey, toKey string) (err error) {
+	t := time.Now()
+	defer func() { DefaultMetrics.recordOperation("copy", t, err) }()
 	failedRsHosts := make(map[string]struct{})
 	host := l.nextRsHost(failedRsHosts)
-	bucket := l.newBucket(host, "")
-	err := bucket.Copy(nil, fromKey, toKey)
+	bucket, err := l.newBucket(host, "")
+	if err != nil {
+		return err
+	}
+	err = bucket.Copy(nil, fromKey, toKey)
 	if err != nil {
 		failedRsHosts[host] = struct{}{}
 		failHostName(host)
 		elog.Info("copy retry 0", host, err)
+		DefaultMetrics.recordRetry("copy")
 		host = l.nextRsHost(failedRsHosts)
-		bucket = l.newBucket(host, "")
+		if bucket, err = l.newBucket(host, ""); err != nil {
+			return err
+		}
 		err = bucket.Copy(nil, fromKey, toKey)
 		if err != nil {
 			failedRsHosts[host] = struct{}{}
@@ -413,17 +476,25 @@ func (l *singleClusterLister) copy(fromKey, toKey string) error {
 	return nil
 }
 
-func (l *singleClusterLister) delete(key string) error {
+func (l *singleClusterLister) delete(key string) (err error) {
+	t := time.Now()
+	defer func() { DefaultMetrics.recordOperation("delete", t, err) }()
 	failedRsHosts := make(map[string]struct{})
 	host := l.nextRsHost(failedRsHosts)
-	bucket := l.newBucket(host, "")
-	err := bucket.Delete(nil, key)
+	bucket, err := l.newBucket(host, "")
+	if err != nil {
+		return err
+	}
+	err = bucket.Delete(nil, key)
 	if err != nil {
 		failedRsHosts[host] = struct{}{}
 		failHostName(host)
 		elog.Info("delete retry 0", host, err)
+		DefaultMetrics.recordRetry("delete")
 		host = l.nextRsHost(failedRsHosts)
-		bucket = l.newBucket(host, "")
+		if bucket, err = l.newBucket(host, ""); err != nil {
+			return err
+		}
 		err = bucket.Delete(nil, key)
 		if err != nil {
 			failedRsHosts[host] = struct{}{}
@@ -439,7 +510,9 @@ func (l *singleClusterLister) delete(key string) error {
 	return nil
 }
 
-func (l *singleClusterLister) listStat(ctx context.Context, paths []string) ([]*FileStat, error) {
+func (l *singleClusterLister) listStat(ctx context.Context, paths []string) (stats []*FileStat, err error) {
+	t := time.Now()
+	defer func() { DefaultMetrics.recordOperation("stat", t, err) }()
 	return l.listStatWithRetries(ctx, paths, 10, 0)
 }
 
@@ -467,7 +540,10 @@ func (l *singleClusterLister) listStatWithRetries(ctx context.Context, paths []s
 				failedRsHostsLock.RLock()
 				host := l.nextRsHost(failedRsHosts)
 				failedRsHostsLock.RUnlock()
-				bucket := l.newBucket(host, "")
+				bucket, err := l.newBucket(host, "")
+				if err != nil {
+					return err
+				}
 				r, err := bucket.BatchStat(ctx, paths...)
 				if err != nil {
 					failedRsHostsLock.Lock()
@@ -475,10 +551,13 @@ func (l *singleClusterLister) listStatWithRetries(ctx context.Context, paths []s
 					failedRsHostsLock.Unlock()
 					failHostName(host)
 					elog.Info("batchStat retry 0", host, err)
+					DefaultMetrics.recordRetry("stat")
 					failedRsHostsLock.RLock()
 					host = l.nextRsHost(failedRsHosts)
 					failedRsHostsLock.RUnlock()
-					bucket = l.newBucket(host, "")
+					if bucket, err = l.newBucket(host, ""); err != nil {
+						return err
+					}
 					r, err = bucket.BatchStat(ctx, paths...)
 					if err != nil {
 						failedRsHostsLock.Lock()
@@ -498,7 +577,7 @@ func (l *singleClusterLister) listStatWithRetries(ctx context.Context, paths []s
 						stats[index+j] = &FileStat{Name: paths[j], Size: -1, code: v.Code}
 						elog.Warn("stat bad file:", paths[j], "with code:", v.Code)
 					} else {
-						stats[index+j] = &FileStat{Name: paths[j], Size: v.Data.Fsize, code: v.Code}
+						stats[index+j] = &FileStat{Name: paths[j], Size: v.Data.Fsize, Hash: v.Data.Hash, code: v.Code}
 					}
 				}
 				return nil
@@ -519,6 +598,7 @@ func (l *singleClusterLister) listStatWithRetries(ctx context.Context, paths []s
 		}
 		if len(failedPath) > 0 {
 			elog.Warn("restat ", len(failedPath), " bad files, retried:", retried)
+			DefaultMetrics.recordRetry("stat")
 			retriedStats, err := l.listStatWithRetries(ctx, failedPath, retries-1, retried+1)
 			if err != nil {
 				return stats, err
@@ -533,11 +613,38 @@ func (l *singleClusterLister) listStatWithRetries(ctx context.Context, paths []s
 }
 
 func (l *singleClusterLister) listPrefix(ctx context.Context, prefix string) ([]string, error) {
+	var files []string
+	if err := l.rangePrefix(ctx, prefix, func(item kodo.ListItem) error {
+		files = append(files, item.Key)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+func (l *singleClusterLister) listPrefixStats(ctx context.Context, prefix string) ([]*FileStat, error) {
+	var stats []*FileStat
+	if err := l.rangePrefix(ctx, prefix, func(item kodo.ListItem) error {
+		stats = append(stats, &FileStat{Name: item.Key, Size: item.Fsize, Hash: item.Hash, code: 200})
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// 分页列举指定前缀下的所有对象，对每个对象调用 fn，fn 返回错误时停止列举
+func (l *singleClusterLister) rangePrefix(ctx context.Context, prefix string, fn func(item kodo.ListItem) error) (err error) {
+	t := time.Now()
+	defer func() { DefaultMetrics.recordOperation("list", t, err) }()
 	failedHosts := make(map[string]struct{})
 	rsHost := l.nextRsHost(failedHosts)
 	rsfHost := l.nextRsfHost(failedHosts)
-	bucket := l.newBucket(rsHost, rsfHost)
-	var files []string
+	bucket, err := l.newBucket(rsHost, rsfHost)
+	if err != nil {
+		return err
+	}
 	marker := ""
 	for {
 		r, _, out, err := bucket.List(ctx, prefix, "", marker, 1000)
@@ -545,14 +652,17 @@ func (l *singleClusterLister) listPrefix(ctx context.Context, prefix string) ([]
 			failedHosts[rsfHost] = struct{}{}
 			failHostName(rsfHost)
 			elog.Info("ListPrefix retry 0", rsfHost, err)
+			DefaultMetrics.recordRetry("list")
 			rsfHost = l.nextRsfHost(failedHosts)
-			bucket = l.newBucket(rsHost, rsfHost)
+			if bucket, err = l.newBucket(rsHost, rsfHost); err != nil {
+				return err
+			}
 			r, _, out, err = bucket.List(ctx, prefix, "", marker, 1000)
 			if err != nil && err != io.EOF {
 				failedHosts[rsfHost] = struct{}{}
 				failHostName(rsfHost)
 				elog.Info("ListPrefix retry 1", rsfHost, err)
-				return nil, err
+				return err
 			} else {
 				succeedHostName(rsfHost)
 			}
@@ -561,7 +671,9 @@ func (l *singleClusterLister) listPrefix(ctx context.Context, prefix string) ([]
 		}
 		elog.Info("list len", marker, len(r))
 		for _, v := range r {
-			files = append(files, v.Key)
+			if err = fn(v); err != nil {
+				return err
+			}
 		}
 
 		if out == "" {
@@ -569,19 +681,23 @@ func (l *singleClusterLister) listPrefix(ctx context.Context, prefix string) ([]
 		}
 		marker = out
 	}
-	return files, nil
+	return nil
 }
 
-func (l *singleClusterLister) newBucket(host, rsfHost string) kodo.Bucket {
+func (l *singleClusterLister) newBucket(host, rsfHost string) (kodo.Bucket, error) {
+	mac, err := l.credentials.Get()
+	if err != nil {
+		return kodo.Bucket{}, err
+	}
 	cfg := kodo.Config{
-		AccessKey: l.credentials.AccessKey,
-		SecretKey: string(l.credentials.SecretKey),
+		AccessKey: mac.AccessKey,
+		SecretKey: string(mac.SecretKey),
 		RSHost:    host,
 		RSFHost:   rsfHost,
 		UpHosts:   l.upHosts,
 	}
 	client := kodo.NewWithoutZone(&cfg)
-	return client.Bucket(l.bucket)
+	return client.Bucket(l.bucket), nil
 }
 
 func (l *Lister) batchStab(r io.Reader) []*FileStat {
@@ -0,0 +1,316 @@
+package operation
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 指标类型
+type MetricType string
+
+const (
+	MetricCounter   MetricType = "counter"
+	MetricGauge     MetricType = "gauge"
+	MetricHistogram MetricType = "histogram"
+)
+
+// 操作耗时直方图的默认分桶，单位为秒
+var DefaultDurationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 300}
+
+// 单个指标样本，直方图会被展开为 _bucket、_sum 和 _count 样本
+type MetricSample struct {
+	Name   string            `json:"name"`
+	Labels map[string]string `json:"labels,omitempty"`
+	Value  float64           `json:"value"`
+}
+
+type metricSeries struct {
+	labelValues []string
+	value       float64
+	buckets     []uint64
+	count       uint64
+}
+
+type metricFamily struct {
+	name       string
+	help       string
+	typ        MetricType
+	labelNames []string
+	buckets    []float64
+	series     map[string]*metricSeries
+}
+
+func (family *metricFamily) get(labelValues []string) *metricSeries {
+	key := strings.Join(labelValues, "\xff")
+	s, ok := family.series[key]
+	if !ok {
+		s = &metricSeries{labelValues: labelValues}
+		if family.typ == MetricHistogram {
+			s.buckets = make([]uint64, len(family.buckets))
+		}
+		family.series[key] = s
+	}
+	return s
+}
+
+// 指标注册表，可以通过 ServeHTTP 以 Prometheus 文本格式导出，也可以通过 Samples 直接读取
+type Metrics struct {
+	lock     sync.Mutex
+	families map[string]*metricFamily
+	names    []string
+	hosts    map[string]struct{}
+}
+
+// 默认指标注册表，operation 包内的上传、下载、列举等操作都会记录到这里
+var DefaultMetrics = NewMetrics()
+
+// 创建新的指标注册表
+func NewMetrics() *Metrics {
+	m := &Metrics{families: make(map[string]*metricFamily), hosts: make(map[string]struct{})}
+	m.register("qiniu_operation_requests_total", "Total number of operations by result.", MetricCounter, "operation", "result")
+	m.register("qiniu_operation_bytes_total", "Total number of bytes transferred by operation and host.", MetricCounter, "operation", "host")
+	m.register("qiniu_operation_discarded_bytes_total", "Total number of bytes sent by failed or retried attempts by operation and host.", MetricCounter, "operation", "host")
+	m.register("qiniu_operation_duration_seconds", "Duration of operations in seconds.", MetricHistogram, "operation")
+	m.register("qiniu_operation_retries_total", "Total number of operation retries.", MetricCounter, "operation")
+	m.register("qiniu_host_requests_total", "Total number of requests sent to host by result.", MetricCounter, "host", "result")
+	m.register("qiniu_host_failures_total", "Total number of times a host has been marked as failed.", MetricCounter, "host")
+	m.register("qiniu_host_healthy", "Whether the host is currently considered healthy (1) or frozen (0).", MetricGauge, "host")
+	m.register("qiniu_queryer_cache_total", "Total number of queryer cache lookups by result.", MetricCounter, "result")
+	return m
+}
+
+func (m *Metrics) register(name, help string, typ MetricType, labelNames ...string) {
+	family := metricFamily{name: name, help: help, typ: typ, labelNames: labelNames, series: make(map[string]*metricSeries)}
+	if typ == MetricHistogram {
+		family.buckets = DefaultDurationBuckets
+	}
+	m.families[name] = &family
+	m.names = append(m.names, name)
+}
+
+func (m *Metrics) add(name string, delta float64, labelValues ...string) {
+	m.lock.Lock()
+	m.families[name].get(labelValues).value += delta
+	m.lock.Unlock()
+}
+
+func (m *Metrics) observe(name string, value float64, labelValues ...string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	family := m.families[name]
+	s := family.get(labelValues)
+	for i, bound := range family.buckets {
+		if value <= bound {
+			s.buckets[i]++
+		}
+	}
+	s.count++
+	s.value += value
+}
+
+// 记录一次操作的结果，耗时从 start 开始计算
+func (m *Metrics) recordOperation(operation string, start time.Time, err error) {
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	m.add("qiniu_operation_requests_total", 1, operation, result)
+	m.observe("qiniu_operation_duration_seconds", time.Since(start).Seconds(), operation)
+}
+
+func (m *Metrics) recordBytes(operation, host string, n int64) {
+	if n > 0 {
+		m.add("qiniu_operation_bytes_total", float64(n), operation, host)
+	}
+}
+
+// 记录失败或者被重试的请求已经发送的字节数，这部分不计入 qiniu_operation_bytes_total
+func (m *Metrics) recordDiscardedBytes(operation, host string, n int64) {
+	if n > 0 {
+		m.add("qiniu_operation_discarded_bytes_total", float64(n), operation, host)
+	}
+}
+
+func (m *Metrics) recordRetry(operation string) {
+	m.add("qiniu_operation_retries_total", 1, operation)
+}
+
+func (m *Metrics) recordHost(host string, succeed bool) {
+	m.lock.Lock()
+	m.hosts[host] = struct{}{}
+	m.lock.Unlock()
+	if succeed {
+		m.add("qiniu_host_requests_total", 1, host, "success")
+	} else {
+		m.add("qiniu_host_requests_total", 1, host, "failure")
+		m.add("qiniu_host_failures_total", 1, host)
+	}
+}
+
+func (m *Metrics) recordQueryerCache(hit bool) {
+	if hit {
+		m.add("qiniu_queryer_cache_total", 1, "hit")
+	} else {
+		m.add("qiniu_queryer_cache_total", 1, "miss")
+	}
+}
+
+// 主机健康状态在读取指标时实时计算
+func (m *Metrics) updateHostHealth() {
+	m.lock.Lock()
+	hosts := make([]string, 0, len(m.hosts))
+	for host := range m.hosts {
+		hosts = append(hosts, host)
+	}
+	m.lock.Unlock()
+
+	for _, host := range hosts {
+		healthy := 0.0
+		if isHostNameValid(host) {
+			healthy = 1
+		}
+		m.lock.Lock()
+		m.families["qiniu_host_healthy"].get([]string{host}).value = healthy
+		m.lock.Unlock()
+	}
+}
+
+// 获取当前所有指标样本
+func (m *Metrics) Samples() []MetricSample {
+	var samples []MetricSample
+	m.each(func(family *metricFamily, name string, labels [][2]string, value float64) {
+		sample := MetricSample{Name: name, Value: value}
+		if len(labels) > 0 {
+			sample.Labels = make(map[string]string, len(labels))
+			for _, label := range labels {
+				sample.Labels[label[0]] = label[1]
+			}
+		}
+		samples = append(samples, sample)
+	})
+	return samples
+}
+
+// 以 Prometheus 文本格式输出所有指标
+func (m *Metrics) WriteText(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	var lastFamily *metricFamily
+	m.each(func(family *metricFamily, name string, labels [][2]string, value float64) {
+		if family != lastFamily {
+			fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s %s\n", family.name, family.help, family.name, family.typ)
+			lastFamily = family
+		}
+		bw.WriteString(name)
+		if len(labels) > 0 {
+			bw.WriteByte('{')
+			for i, label := range labels {
+				if i > 0 {
+					bw.WriteByte(',')
+				}
+				fmt.Fprintf(bw, "%s=\"%s\"", label[0], escapeLabelValue(label[1]))
+			}
+			bw.WriteByte('}')
+		}
+		bw.WriteByte(' ')
+		bw.WriteString(formatMetricValue(value))
+		bw.WriteByte('\n')
+	})
+	return bw.Flush()
+}
+
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	if r.Method != http.MethodHead {
+		m.WriteText(w)
+	}
+}
+
+func (m *Metrics) each(fn func(family *metricFamily, name string, labels [][2]string, value float64)) {
+	m.updateHostHealth()
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for _, familyName := range m.names {
+		family := m.families[familyName]
+		keys := make([]string, 0, len(family.series))
+		for key := range family.series {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			s := family.series[key]
+			labels := make([][2]string, len(family.labelNames))
+			for i, labelName := range family.labelNames {
+				labels[i] = [2]string{labelName, s.labelValues[i]}
+			}
+			if family.typ != MetricHistogram {
+				fn(family, family.name, labels, s.value)
+				continue
+			}
+			for i, bound := range family.buckets {
+				fn(family, family.name+"_bucket", append(labels[:len(labels):len(labels)], [2]string{"le", formatMetricValue(bound)}), float64(s.buckets[i]))
+			}
+			fn(family, family.name+"_bucket", append(labels[:len(labels):len(labels)], [2]string{"le", "+Inf"}), float64(s.count))
+			fn(family, family.name+"_sum", labels, s.value)
+			fn(family, family.name+"_count", labels, float64(s.count))
+		}
+	}
+}
+
+func escapeLabelValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+func formatMetricValue(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	default:
+		return strconv.FormatFloat(value, 'g', -1, 64)
+	}
+}
+
+// 统计读取字节数的 ReadCloser，关闭时记录到指标中
+type meteredReadCloser struct {
+	io.ReadCloser
+	operation string
+	host      string
+	n         int64
+	once      sync.Once
+}
+
+func (r *meteredReadCloser) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+func (r *meteredReadCloser) Close() error {
+	r.once.Do(func() { DefaultMetrics.recordBytes(r.operation, r.host, r.n) })
+	return r.ReadCloser.Close()
+}
+
+// 统计读取字节数的 Reader
+type countingReader struct {
+	io.Reader
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.n += int64(n)
+	return n, err
+}
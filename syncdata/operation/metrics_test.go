@@ -0,0 +1,50 @@
+package operation
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetrics(t *testing.T) {
+	m := NewMetrics()
+	m.recordOperation("upload_file", time.Now().Add(-2*time.Second), nil)
+	m.recordOperation("upload_file", time.Now(), errors.New("failed"))
+	m.recordBytes("download_file", "http://io\"1", 1024)
+	m.recordRetry("upload_file")
+	m.recordHost("http://metrics-test-host", true)
+	m.recordQueryerCache(true)
+
+	values := make(map[string]float64)
+	for _, sample := range m.Samples() {
+		var labels []string
+		for _, name := range []string{"operation", "result", "host", "le"} {
+			if value, ok := sample.Labels[name]; ok {
+				labels = append(labels, name+"="+value)
+			}
+		}
+		values[sample.Name+"{"+strings.Join(labels, ",")+"}"] = sample.Value
+	}
+	assert.Equal(t, 1.0, values["qiniu_operation_requests_total{operation=upload_file,result=success}"])
+	assert.Equal(t, 1.0, values["qiniu_operation_requests_total{operation=upload_file,result=failure}"])
+	assert.Equal(t, 1.0, values["qiniu_operation_duration_seconds_bucket{operation=upload_file,le=1}"])
+	assert.Equal(t, 2.0, values["qiniu_operation_duration_seconds_bucket{operation=upload_file,le=+Inf}"])
+	assert.Equal(t, 2.0, values["qiniu_operation_duration_seconds_count{operation=upload_file}"])
+	assert.Equal(t, 1024.0, values["qiniu_operation_bytes_total{operation=download_file,host=http://io\"1}"])
+	assert.Equal(t, 1.0, values["qiniu_operation_retries_total{operation=upload_file}"])
+	assert.Equal(t, 1.0, values["qiniu_host_requests_total{result=success,host=http://metrics-test-host}"])
+	assert.Equal(t, 1.0, values["qiniu_host_healthy{host=http://metrics-test-host}"])
+	assert.Equal(t, 1.0, values["qiniu_queryer_cache_total{result=hit}"])
+
+	var buf bytes.Buffer
+	assert.NoError(t, m.WriteText(&buf))
+	text := buf.String()
+	assert.Contains(t, text, "# TYPE qiniu_operation_duration_seconds histogram\n")
+	assert.Contains(t, text, `qiniu_operation_bytes_total{operation="download_file",host="http://io\"1"} 1024`+"\n")
+	assert.Contains(t, text, `qiniu_operation_duration_seconds_bucket{operation="upload_file",le="+Inf"} 2`+"\n")
+	assert.Equal(t, 1, strings.Count(text, "# HELP qiniu_operation_requests_total "))
+}
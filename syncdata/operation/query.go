@@ -46,9 +46,9 @@ var (
 type (
 	// 域名查询器
 	Queryer struct {
-		ak      string
-		bucket  string
-		ucHosts []string
+		credentials CredentialsProvider
+		bucket      string
+		ucHosts     []string
 	}
 
 	cache struct {
@@ -81,9 +81,9 @@ func init() {
 // 根据配置创建域名查询器
 func NewQueryer(c *Config) *Queryer {
 	queryer := Queryer{
-		ak:      c.Ak,
-		bucket:  c.Bucket,
-		ucHosts: dupStrings(c.UcHosts),
+		credentials: c.credentialsProvider(),
+		bucket:      c.Bucket,
+		ucHosts:     dupStrings(c.UcHosts),
 	}
 	shuffleHosts(queryer.ucHosts)
 	return &queryer
@@ -151,6 +151,7 @@ func (queryer *Queryer) fromDomainsToUrls(https bool, domains []string) (urls []
 func (queryer *Queryer) query() (*cache, error) {
 	var err error
 	c := queryer.getCache()
+	DefaultMetrics.recordQueryerCache(c != nil)
 	if c == nil {
 		return func() (*cache, error) {
 			var err error
@@ -181,8 +182,12 @@ func (queryer *Queryer) mustQuery() (c *cache, err error) {
 	var req *http.Request
 	var resp *http.Response
 
+	mac, err := queryer.credentials.Get()
+	if err != nil {
+		return nil, err
+	}
 	query := make(url.Values, 2)
-	query.Set("ak", queryer.ak)
+	query.Set("ak", mac.AccessKey)
 	query.Set("bucket", queryer.bucket)
 
 	failedUcHosts := make(map[string]struct{})
@@ -267,11 +272,15 @@ func (queryer *Queryer) setCache(c *cache) {
 }
 
 func (queryer *Queryer) cacheKey() string {
+	var ak string
+	if mac, err := queryer.credentials.Get(); err == nil {
+		ak = mac.AccessKey
+	}
 	ucHosts := dupStrings(queryer.ucHosts)
 	sort.Strings(ucHosts)
 	serializedUcHosts := strings.Join(ucHosts, "$")
 	hostsCrc32 := crc32.ChecksumIEEE([]byte(serializedUcHosts))
-	return fmt.Sprintf("cache-key-v2:%s:%s:%d", queryer.ak, queryer.bucket, hostsCrc32)
+	return fmt.Sprintf("cache-key-v2:%s:%s:%d", ak, queryer.bucket, hostsCrc32)
 }
 
 var curUcHostIndex uint32 = 0
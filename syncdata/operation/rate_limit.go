@@ -0,0 +1,37 @@
+package operation
+
+import (
+	"sync"
+
+	"github.com/qiniupd/qiniu-go-sdk/api.v8/limit"
+)
+
+// 进程级别的上传和下载限速器，默认不限速，可以在运行时通过 SetRate 调整
+var (
+	GlobalUpRateLimiter   = limit.NewRateLimiter(0, 0)
+	GlobalDownRateLimiter = limit.NewRateLimiter(0, 0)
+)
+
+var rateLimitersLock sync.Mutex
+
+// 集群的上传限速器，初始速率为 up_rate_limit（字节每秒），不大于 0 时不限速
+// 同一个配置返回同一个限速器，可以在运行时通过 SetRate 调整
+func (config *Config) UpRateLimiter() *limit.RateLimiter {
+	rateLimitersLock.Lock()
+	defer rateLimitersLock.Unlock()
+	if config.upRateLimiter == nil {
+		config.upRateLimiter = limit.NewRateLimiter(config.UpRateLimit, 0)
+	}
+	return config.upRateLimiter
+}
+
+// 集群的下载限速器，初始速率为 down_rate_limit（字节每秒），不大于 0 时不限速
+// 同一个配置返回同一个限速器，可以在运行时通过 SetRate 调整
+func (config *Config) DownRateLimiter() *limit.RateLimiter {
+	rateLimitersLock.Lock()
+	defer rateLimitersLock.Unlock()
+	if config.downRateLimiter == nil {
+		config.downRateLimiter = limit.NewRateLimiter(config.DownRateLimit, 0)
+	}
+	return config.downRateLimiter
+}
@@ -1,8 +1,11 @@
 package operation
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"strings"
@@ -11,10 +14,13 @@ import (
 
 type server struct {
 	up       *Uploader
+	down     *Downloader
 	lister   *Lister
 	del      bool
 	downPath string
 	sim      bool
+	guard    *serverGuard
+	jobs     *jobQueue
 }
 
 type Req struct {
@@ -36,7 +42,7 @@ func (s *server) download(res http.ResponseWriter, req *http.Request) {
 	elog.Info("download", req.Method, path, req.URL.RawQuery, err)
 	elog.Info("ranges", req.Header.Get("Range"))
 	if err != nil {
-		res.WriteHeader(http.StatusNotFound)
+		writeError(res, http.StatusNotFound, err)
 		return
 	}
 	ServeContent(res, req, path, time.Now(), f)
@@ -44,11 +50,43 @@ func (s *server) download(res http.ResponseWriter, req *http.Request) {
 }
 
 func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.ContentLength > s.guard.maxRequestBodySize {
+		writeError(w, http.StatusRequestEntityTooLarge, errors.New("request body too large"))
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, s.guard.maxRequestBodySize)
+	if ok, err := s.guard.authorize(r); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	} else if !ok {
+		log.Println("unauthorized request", r.Method, r.URL.Path, r.RemoteAddr)
+		writeError(w, http.StatusUnauthorized, errors.New("unauthorized"))
+		return
+	}
+
+	if r.URL.Path == "/metrics" && (r.Method == http.MethodGet || r.Method == http.MethodHead) {
+		DefaultMetrics.ServeHTTP(w, r)
+		return
+	}
+	if r.URL.Path == "/jobs" || strings.HasPrefix(r.URL.Path, "/jobs/") {
+		s.serveJobs(w, r)
+		return
+	}
+	if strings.HasPrefix(r.URL.Path, "/objects/") {
+		s.serveObjects(w, r)
+		return
+	}
+
 	switch r.Method {
 	case http.MethodPost:
-		if r.URL.Path == "/stat" {
+		switch r.URL.Path {
+		case "/stat":
 			s.listStat(w, r)
-		} else {
+		case "/copy":
+			s.copyObject(w, r)
+		case "/move":
+			s.moveObject(w, r)
+		default:
 			s.upload(w, r)
 		}
 	case http.MethodHead:
@@ -60,48 +98,49 @@ func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			s.download(w, r)
 		}
 	default:
-		w.WriteHeader(http.StatusMethodNotAllowed)
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+	}
+}
+
+func (s *server) serveJobs(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/jobs"), "/")
+	switch {
+	case id == "" && r.Method == http.MethodGet:
+		s.listJobs(w, r)
+	case id != "" && r.Method == http.MethodGet:
+		s.getJob(w, r, id)
+	case id != "" && r.Method == http.MethodDelete:
+		s.cancelJob(w, r, id)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
 	}
 }
 
 func (s *server) listStat(w http.ResponseWriter, r *http.Request) {
 	var keys []string
 	if err := json.NewDecoder(r.Body).Decode(&keys); err != nil {
-		log.Println("json decode error", err)
-		w.WriteHeader(http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, err)
 		return
 	}
 	ret, err := s.lister.listStat(r.Context(), keys)
 	if err != nil {
-		log.Println("list stats error", err)
-		w.WriteHeader(http.StatusBadRequest)
-		return
-	}
-	j, err := json.Marshal(ret)
-	if err != nil {
-		log.Println("json marshal error", err)
-		w.WriteHeader(http.StatusBadRequest)
+		writeError(w, errorStatusCode(err), err)
 		return
 	}
-	w.WriteHeader(http.StatusOK)
-	w.Write(j)
+	writeJson(w, http.StatusOK, ret)
 }
 
 func (s *server) listFiles(w http.ResponseWriter, r *http.Request) {
 	prefix := r.URL.Query().Get("prefix")
-	ret := s.lister.ListPrefix(prefix)
-	if ret == nil {
-		w.WriteHeader(http.StatusBadRequest)
-		return
-	}
-	j, err := json.Marshal(ret)
+	ret, err := s.lister.listPrefix(r.Context(), prefix)
 	if err != nil {
-		log.Println("json marshal error", err)
-		w.WriteHeader(http.StatusBadRequest)
+		writeError(w, errorStatusCode(err), err)
 		return
 	}
-	w.WriteHeader(http.StatusOK)
-	w.Write(j)
+	if ret == nil {
+		ret = []string{}
+	}
+	writeJson(w, http.StatusOK, ret)
 }
 
 func (s *server) upload(w http.ResponseWriter, r *http.Request) {
@@ -110,53 +149,181 @@ func (s *server) upload(w http.ResponseWriter, r *http.Request) {
 	err := d.Decode(&reqs)
 	log.Printf("receive request %+v\n", reqs)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		log.Println(err)
+		writeError(w, http.StatusBadRequest, err)
 		return
 	}
-	go func() {
-		for _, req := range reqs {
-			if s.sim {
-				err := os.Rename(req.Path, s.downPath+renameFile(req.Path))
-				log.Println("move ", req.Path, s.downPath+renameFile(req.Path), err)
-			} else {
-				key := req.Key
-				if key == "" {
-					key = req.Path
-				}
-				s.up.Upload(req.Path, key)
-				if req.Delete == nil {
-					if s.del {
-						os.Remove(req.Path)
-					}
-				} else if *req.Delete {
-					os.Remove(req.Path)
-				}
-			}
+	for _, req := range reqs {
+		if err = s.guard.checkLocalPath(req.Path); err != nil {
+			writeError(w, errorStatusCode(err), errors.New(req.Path+": "+err.Error()))
+			return
 		}
-	}()
+	}
+	id, err := s.jobs.submit(reqs)
+	if err == ErrJobsClosed {
+		writeError(w, errorStatusCode(err), err)
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJson(w, http.StatusOK, map[string]string{"id": id})
+}
 
-	w.WriteHeader(http.StatusOK)
+func (s *server) processReq(ctx context.Context, req Req) error {
+	// 提交后路径中的符号链接可能已经改变，打开文件前再检查一次
+	if err := s.guard.checkLocalPath(req.Path); err != nil {
+		return err
+	}
+	if s.sim {
+		err := os.Rename(req.Path, s.downPath+renameFile(req.Path))
+		log.Println("move ", req.Path, s.downPath+renameFile(req.Path), err)
+		return err
+	}
+	key := req.Key
+	if key == "" {
+		key = req.Path
+	}
+	if _, err := s.up.UploadWithOptions(req.Path, key, &UploadOptions{Context: ctx}); err != nil {
+		return err
+	}
+	if (req.Delete == nil && s.del) || (req.Delete != nil && *req.Delete) {
+		if err := os.Remove(req.Path); err != nil {
+			log.Println("remove uploaded file error", req.Path, err)
+		}
+	}
+	return nil
 }
 
-func StartServer(cfg *Config) (*http.Server, error) {
+func (s *server) listJobs(w http.ResponseWriter, r *http.Request) {
+	writeJson(w, http.StatusOK, s.jobs.list())
+}
+
+func (s *server) getJob(w http.ResponseWriter, r *http.Request, id string) {
+	job, err := s.jobs.get(id)
+	if err != nil {
+		writeError(w, errorStatusCode(err), err)
+		return
+	}
+	writeJson(w, http.StatusOK, job)
+}
+
+func (s *server) cancelJob(w http.ResponseWriter, r *http.Request, id string) {
+	job, err := s.jobs.cancel(id)
+	if err != nil {
+		writeError(w, errorStatusCode(err), err)
+		return
+	}
+	writeJson(w, http.StatusOK, job)
+}
+
+func writeJson(w http.ResponseWriter, code int, v interface{}) {
+	j, err := json.Marshal(v)
+	if err != nil {
+		log.Println("json marshal error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(j)
+}
+
+// 服务器关闭时的报告
+type ShutdownReport struct {
+	// 尚未开始或尚未完成的文件，如果配置了 jobs_path，它们会在下次启动时重新上传
+	Unfinished []*UnfinishedJobItem `json:"unfinished"`
+}
+
+// 上传服务器
+type Server struct {
+	httpServer *http.Server
+	jobs       *jobQueue
+	listener   net.Listener
+	errCh      chan error
+}
+
+// 服务器实际监听的地址
+func (svr *Server) Addr() net.Addr {
+	return svr.listener.Addr()
+}
+
+// 服务器运行期间发生的错误，服务器正常关闭后 channel 会被关闭
+func (svr *Server) Err() <-chan error {
+	return svr.errCh
+}
+
+// 关闭服务器：停止接受新的请求，等待正在处理的请求和正在上传的文件完成
+// ctx 超时后不再等待，未完成的任务会被持久化并在报告中返回
+func (svr *Server) Shutdown(ctx context.Context) (*ShutdownReport, error) {
+	err := svr.httpServer.Shutdown(ctx)
+	if closeErr := svr.jobs.close(ctx); err == nil {
+		err = closeErr
+	}
+	report := ShutdownReport{Unfinished: svr.jobs.unfinished()}
+	if len(report.Unfinished) > 0 {
+		elog.Warn("upload server shut down with", len(report.Unfinished), "unfinished files")
+	}
+	return &report, err
+}
+
+// 启动上传服务器，监听失败时直接返回错误
+func StartServer(cfg *Config) (*Server, error) {
+	guard, err := newServerGuard(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if (cfg.TlsCertFile == "") != (cfg.TlsKeyFile == "") {
+		return nil, errors.New("tls_cert_file and tls_key_file must be configured together")
+	}
+	if !guard.authEnabled() {
+		elog.Warn("upload server is started without authentication")
+	}
 	s := server{
 		up:       NewUploader(cfg),
+		down:     NewDownloader(cfg),
 		del:      cfg.Delete,
 		downPath: cfg.DownPath,
 		sim:      cfg.Sim,
 		lister:   NewLister(cfg),
+		guard:    guard,
+	}
+	if s.jobs, err = newJobQueue(cfg.JobsPath, cfg.JobConcurrency, s.processReq); err != nil {
+		return nil, err
+	}
+
+	addr := cfg.Addr
+	if addr == "" {
+		if cfg.TlsCertFile != "" {
+			addr = ":https"
+		} else {
+			addr = ":http"
+		}
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
 	}
-	srv := &http.Server{
-		Addr:    cfg.Addr,
-		Handler: &s,
+	svr := Server{
+		httpServer: &http.Server{Addr: cfg.Addr, Handler: &s},
+		jobs:       s.jobs,
+		listener:   listener,
+		errCh:      make(chan error, 1),
 	}
+	s.jobs.start()
 
 	go func() {
 		// service connections
-		if err := srv.ListenAndServe(); err != nil {
-			log.Panicln("upload server failed: " + err.Error())
+		var err error
+		if cfg.TlsCertFile != "" {
+			err = svr.httpServer.ServeTLS(listener, cfg.TlsCertFile, cfg.TlsKeyFile)
+		} else {
+			err = svr.httpServer.Serve(listener)
+		}
+		if err != nil && err != http.ErrServerClosed {
+			elog.Error("upload server failed:", err)
+			svr.errCh <- err
 		}
+		close(svr.errCh)
 	}()
-	return srv, nil
+	return &svr, nil
 }
@@ -0,0 +1,163 @@
+package operation
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/qiniupd/qiniu-go-sdk/api.v7/auth/qbox"
+	"github.com/qiniupd/qiniu-go-sdk/x/bytes.v7/seekable"
+)
+
+const defaultMaxRequestBodySize = 4 * 1024 * 1024
+
+// QBox 签名请求中携带签名时间（Unix 时间戳，单位为秒）的头部
+const ServerDateHeader = "X-Qiniu-Date"
+
+// QBox 签名的有效期，签名时间与服务器时间相差超过这个值时拒绝请求，避免请求被截获后无限期重放
+const serverSignatureExpiry = 5 * time.Minute
+
+var ErrPathNotAllowed = errors.New("local path is not allowed")
+
+// 服务器鉴权及本地路径限制
+type serverGuard struct {
+	token              string
+	mac                *qbox.Mac
+	allowedDirs        []string
+	maxRequestBodySize int64
+}
+
+func newServerGuard(cfg *Config) (*serverGuard, error) {
+	guard := serverGuard{
+		token:              cfg.ServerToken,
+		maxRequestBodySize: cfg.MaxRequestBodySize,
+	}
+	if cfg.ServerAk != "" && cfg.ServerSk != "" {
+		guard.mac = &qbox.Mac{AccessKey: cfg.ServerAk, SecretKey: []byte(cfg.ServerSk)}
+	}
+	if guard.maxRequestBodySize <= 0 {
+		guard.maxRequestBodySize = defaultMaxRequestBodySize
+	}
+	for _, dir := range cfg.AllowedPaths {
+		realDir, err := realPath(dir)
+		if err != nil {
+			return nil, err
+		}
+		guard.allowedDirs = append(guard.allowedDirs, realDir)
+	}
+	return &guard, nil
+}
+
+func (guard *serverGuard) authEnabled() bool {
+	return guard.token != "" || guard.mac != nil
+}
+
+// 校验请求，支持 `Authorization: Bearer <token>` 和 `Authorization: QBox <ak>:<sign>` 两种方式
+// QBox 签名方式见 SignServerRequest，签名时间超出有效期的请求会被拒绝
+func (guard *serverGuard) authorize(req *http.Request) (bool, error) {
+	if !guard.authEnabled() {
+		return true, nil
+	}
+	auth := req.Header.Get("Authorization")
+	if guard.token != "" && strings.HasPrefix(auth, "Bearer ") {
+		token := strings.TrimPrefix(auth, "Bearer ")
+		return subtle.ConstantTimeCompare([]byte(token), []byte(guard.token)) == 1, nil
+	}
+	if guard.mac != nil && strings.HasPrefix(auth, "QBox ") {
+		date, err := strconv.ParseInt(req.Header.Get(ServerDateHeader), 10, 64)
+		if err != nil {
+			return false, nil
+		}
+		if skew := time.Since(time.Unix(date, 0)); skew > serverSignatureExpiry || skew < -serverSignatureExpiry {
+			return false, nil
+		}
+		token, err := signServerRequest(guard.mac, req)
+		if err != nil {
+			return false, err
+		}
+		return subtle.ConstantTimeCompare([]byte(auth), []byte("QBox "+token)) == 1, nil
+	}
+	return false, nil
+}
+
+// 为发往上传服务器的请求设置签名时间和 QBox 签名，ak、sk 对应配置中的 server_ak、server_sk。
+// 签名内容包括 Method、Path、Query、签名时间以及请求体，签名在一段时间后失效。
+func SignServerRequest(ak, sk string, req *http.Request) error {
+	req.Header.Set(ServerDateHeader, strconv.FormatInt(time.Now().Unix(), 10))
+	token, err := signServerRequest(qbox.NewMac(ak, sk), req)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "QBox "+token)
+	return nil
+}
+
+func signServerRequest(mac *qbox.Mac, req *http.Request) (string, error) {
+	h := hmac.New(sha1.New, mac.SecretKey)
+	data := req.Method + " " + req.URL.Path
+	if req.URL.RawQuery != "" {
+		data += "?" + req.URL.RawQuery
+	}
+	io.WriteString(h, data+"\n"+ServerDateHeader+": "+req.Header.Get(ServerDateHeader)+"\n\n")
+	if req.ContentLength != 0 && req.Body != nil {
+		body, err := seekable.New(req)
+		if err != nil {
+			return "", err
+		}
+		h.Write(body.Bytes())
+	}
+	return mac.AccessKey + ":" + base64.URLEncoding.EncodeToString(h.Sum(nil)), nil
+}
+
+// 检查本地路径是否位于允许的目录中，未配置允许的目录时不做限制
+func (guard *serverGuard) checkLocalPath(path string) error {
+	if len(guard.allowedDirs) == 0 {
+		return nil
+	}
+	if path == "" {
+		return ErrPathNotAllowed
+	}
+	realFilePath, err := realPath(path)
+	if err != nil {
+		return err
+	}
+	for _, dir := range guard.allowedDirs {
+		if realFilePath == dir || strings.HasPrefix(realFilePath, dir+string(filepath.Separator)) {
+			return nil
+		}
+	}
+	return ErrPathNotAllowed
+}
+
+// 获取绝对路径并解析符号链接，避免通过 `..` 或符号链接逃逸出允许的目录
+// 路径不存在时解析最深的已存在的上级目录，再拼接剩余的部分，避免通过指向外部的上级目录逃逸
+func realPath(path string) (string, error) {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	var rest []string
+	for existing := absPath; ; {
+		realPath, err := filepath.EvalSymlinks(existing)
+		if err == nil {
+			return filepath.Join(append([]string{realPath}, rest...)...), nil
+		} else if !os.IsNotExist(err) {
+			return "", err
+		}
+		parent := filepath.Dir(existing)
+		if parent == existing {
+			return absPath, nil
+		}
+		rest = append([]string{filepath.Base(existing)}, rest...)
+		existing = parent
+	}
+}
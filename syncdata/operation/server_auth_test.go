@@ -0,0 +1,117 @@
+package operation
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/qiniupd/qiniu-go-sdk/api.v7/auth/qbox"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServerGuardAuthorize(t *testing.T) {
+	guard, err := newServerGuard(&Config{ServerToken: "token", ServerAk: "ak", ServerSk: "sk"})
+	assert.NoError(t, err)
+
+	req, _ := http.NewRequest(http.MethodGet, "http://localhost/list?prefix=a", nil)
+	ok, err := guard.authorize(req)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	req.Header.Set("Authorization", "Bearer token")
+	ok, err = guard.authorize(req)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	req.Header.Set("Authorization", "Bearer wrong")
+	ok, err = guard.authorize(req)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	body := `[{"path": "/data/file"}]`
+	req, _ = http.NewRequest(http.MethodPost, "http://localhost/", strings.NewReader(body))
+	assert.NoError(t, SignServerRequest("ak", "sk", req))
+	ok, err = guard.authorize(req)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	b, err := ioutil.ReadAll(req.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, string(b), body)
+	signed := req.Header
+
+	req, _ = http.NewRequest(http.MethodPost, "http://localhost/", strings.NewReader(`[{"path": "/etc/passwd"}]`))
+	req.Header = signed
+	ok, err = guard.authorize(req)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	// 签名包含 Method，GET 的签名不能用于 DELETE
+	req, _ = http.NewRequest(http.MethodGet, "http://localhost/objects/key", nil)
+	assert.NoError(t, SignServerRequest("ak", "sk", req))
+	ok, err = guard.authorize(req)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	req.Method = http.MethodDelete
+	ok, err = guard.authorize(req)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	// 没有签名时间或签名已经过期
+	req, _ = http.NewRequest(http.MethodGet, "http://localhost/objects/key", nil)
+	sign, err := qbox.NewMac("ak", "sk").SignRequest(req, false)
+	assert.NoError(t, err)
+	req.Header.Set("Authorization", "QBox "+sign)
+	ok, err = guard.authorize(req)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	req.Header.Set(ServerDateHeader, strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10))
+	sign, err = signServerRequest(qbox.NewMac("ak", "sk"), req)
+	assert.NoError(t, err)
+	req.Header.Set("Authorization", "QBox "+sign)
+	ok, err = guard.authorize(req)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func TestServerGuardCheckLocalPath(t *testing.T) {
+	dirPath, err := ioutil.TempDir("", "allowed")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dirPath)
+
+	allowedDir := filepath.Join(dirPath, "allowed")
+	assert.NoError(t, os.Mkdir(allowedDir, 0700))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dirPath, "secret"), []byte("secret"), 0600))
+	assert.NoError(t, os.Symlink(filepath.Join(dirPath, "secret"), filepath.Join(allowedDir, "link")))
+
+	guard, err := newServerGuard(&Config{AllowedPaths: []string{allowedDir}})
+	assert.NoError(t, err)
+	assert.NoError(t, guard.checkLocalPath(filepath.Join(allowedDir, "file")))
+	assert.Equal(t, guard.checkLocalPath(filepath.Join(allowedDir, "..", "secret")), ErrPathNotAllowed)
+	assert.Equal(t, guard.checkLocalPath(filepath.Join(allowedDir, "link")), ErrPathNotAllowed)
+	// 不存在的文件位于指向外部的目录链接中
+	assert.NoError(t, os.Symlink(dirPath, filepath.Join(allowedDir, "dirlink")))
+	assert.Equal(t, guard.checkLocalPath(filepath.Join(allowedDir, "dirlink", "missing", "file")), ErrPathNotAllowed)
+	assert.NoError(t, guard.checkLocalPath(filepath.Join(allowedDir, "missing", "file")))
+
+	// 提交之后目录被替换为指向外部的链接，处理时再次检查
+	s := &server{guard: guard, sim: true}
+	assert.NoError(t, os.Mkdir(filepath.Join(allowedDir, "sub"), 0700))
+	path := filepath.Join(allowedDir, "sub", "secret")
+	assert.NoError(t, guard.checkLocalPath(path))
+	assert.NoError(t, os.Remove(filepath.Join(allowedDir, "sub")))
+	assert.NoError(t, os.Symlink(dirPath, filepath.Join(allowedDir, "sub")))
+	assert.Equal(t, ErrPathNotAllowed, s.processReq(context.Background(), Req{Path: path}))
+	assert.Equal(t, guard.checkLocalPath(allowedDir+"-other"), ErrPathNotAllowed)
+	assert.Equal(t, guard.checkLocalPath(""), ErrPathNotAllowed)
+
+	guard, err = newServerGuard(&Config{})
+	assert.NoError(t, err)
+	assert.NoError(t, guard.checkLocalPath("/etc/passwd"))
+}
@@ -0,0 +1,464 @@
+package operation
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// 上传任务状态
+type JobStatus string
+
+const (
+	JobPending  JobStatus = "pending"
+	JobRunning  JobStatus = "running"
+	JobDone     JobStatus = "done"
+	JobFailed   JobStatus = "failed"
+	JobCanceled JobStatus = "canceled"
+)
+
+const (
+	defaultJobConcurrency     = 4
+	defaultJobRetention       = 24 * time.Hour
+	defaultJobPersistInterval = time.Second
+)
+
+var (
+	ErrJobNotFound = errors.New("job not found")
+	ErrJobFinished = errors.New("job already finished")
+	ErrJobsClosed  = errors.New("job queue is closed")
+)
+
+// 上传任务中的单个文件
+type JobItem struct {
+	Req
+	Status JobStatus `json:"status"`
+	Error  string    `json:"error,omitempty"`
+}
+
+// 上传任务
+type Job struct {
+	Id         string     `json:"id"`
+	Items      []*JobItem `json:"items"`
+	CreatedAt  time.Time  `json:"created_at"`
+	FinishedAt time.Time  `json:"finished_at"`
+
+	// 取消任务时中止正在上传的文件
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func (job *Job) initContext() {
+	job.ctx, job.cancel = context.WithCancel(context.Background())
+}
+
+func (job *Job) finished() bool {
+	for _, item := range job.Items {
+		if item.Status == JobPending || item.Status == JobRunning {
+			return false
+		}
+	}
+	return true
+}
+
+// 上传任务概要
+type JobSummary struct {
+	Id         string            `json:"id"`
+	CreatedAt  time.Time         `json:"created_at"`
+	FinishedAt time.Time         `json:"finished_at"`
+	Counts     map[JobStatus]int `json:"counts"`
+}
+
+// 服务器关闭时尚未完成的文件
+type UnfinishedJobItem struct {
+	JobId string `json:"job_id"`
+	JobItem
+}
+
+type jobTask struct {
+	job   *Job
+	index int
+}
+
+// 上传任务队列，使用固定数量的 worker 处理，任务状态可持久化到磁盘
+// 文件上传完成后的状态变化由后台 goroutine 合并后按 persistInterval 写入，避免每个文件都重写一遍所有任务
+type jobQueue struct {
+	lock            sync.Mutex
+	cond            *sync.Cond
+	jobs            map[string]*Job
+	tasks           []jobTask
+	closed          bool
+	process         func(context.Context, Req) error
+	concurrency     int
+	retention       time.Duration
+	persistPath     string
+	persistLock     sync.Mutex
+	persistInterval time.Duration
+	dirty           chan struct{}
+	stopPersist     chan struct{}
+	persisterWg     sync.WaitGroup
+	workersWg       sync.WaitGroup
+}
+
+// process 的 ctx 在任务被取消时取消
+func newJobQueue(persistPath string, concurrency int, process func(context.Context, Req) error) (*jobQueue, error) {
+	if concurrency <= 0 {
+		concurrency = defaultJobConcurrency
+	}
+	queue := jobQueue{
+		jobs:            make(map[string]*Job),
+		process:         process,
+		concurrency:     concurrency,
+		retention:       defaultJobRetention,
+		persistPath:     persistPath,
+		persistInterval: defaultJobPersistInterval,
+		dirty:           make(chan struct{}, 1),
+		stopPersist:     make(chan struct{}),
+	}
+	queue.cond = sync.NewCond(&queue.lock)
+	if err := queue.load(); err != nil {
+		return nil, err
+	}
+	return &queue, nil
+}
+
+func (queue *jobQueue) start() {
+	if queue.persistPath != "" {
+		queue.persisterWg.Add(1)
+		go queue.persistLoop()
+	}
+	for i := 0; i < queue.concurrency; i++ {
+		queue.workersWg.Add(1)
+		go queue.work()
+	}
+}
+
+func (queue *jobQueue) work() {
+	defer queue.workersWg.Done()
+	for {
+		task, ok := queue.next()
+		if !ok {
+			return
+		}
+		item := task.job.Items[task.index]
+		err := queue.process(task.job.ctx, item.Req)
+		queue.lock.Lock()
+		if err != nil && task.job.ctx.Err() != nil {
+			item.Status = JobCanceled
+			item.Error = err.Error()
+		} else if err != nil {
+			item.Status = JobFailed
+			item.Error = err.Error()
+			elog.Warn("job item failed:", task.job.Id, item.Path, err)
+		} else {
+			item.Status = JobDone
+		}
+		if task.job.finished() {
+			task.job.FinishedAt = time.Now()
+		}
+		queue.lock.Unlock()
+		queue.markDirty()
+	}
+}
+
+func (queue *jobQueue) next() (jobTask, bool) {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	for {
+		for len(queue.tasks) > 0 && !queue.closed {
+			task := queue.tasks[0]
+			queue.tasks = queue.tasks[1:]
+			if item := task.job.Items[task.index]; item.Status == JobPending {
+				item.Status = JobRunning
+				return task, true
+			}
+		}
+		if queue.closed {
+			return jobTask{}, false
+		}
+		queue.cond.Wait()
+	}
+}
+
+// 添加一组上传请求，返回任务 ID
+func (queue *jobQueue) submit(reqs []Req) (string, error) {
+	id, err := newJobId()
+	if err != nil {
+		return "", err
+	}
+	job := Job{Id: id, Items: make([]*JobItem, len(reqs)), CreatedAt: time.Now()}
+	job.initContext()
+	for i, req := range reqs {
+		job.Items[i] = &JobItem{Req: req, Status: JobPending}
+	}
+	if len(reqs) == 0 {
+		job.FinishedAt = job.CreatedAt
+	}
+
+	queue.lock.Lock()
+	if queue.closed {
+		queue.lock.Unlock()
+		return "", ErrJobsClosed
+	}
+	queue.expire()
+	queue.jobs[id] = &job
+	queue.enqueue(&job)
+	queue.lock.Unlock()
+
+	queue.persist()
+	return id, nil
+}
+
+func (queue *jobQueue) enqueue(job *Job) {
+	for i, item := range job.Items {
+		if item.Status == JobPending {
+			queue.tasks = append(queue.tasks, jobTask{job: job, index: i})
+		}
+	}
+	queue.cond.Broadcast()
+}
+
+// 清理完成时间超过保留时长的任务，调用时需持有锁
+func (queue *jobQueue) expire() {
+	for id, job := range queue.jobs {
+		if !job.FinishedAt.IsZero() && job.FinishedAt.Add(queue.retention).Before(time.Now()) {
+			delete(queue.jobs, id)
+		}
+	}
+}
+
+// 获取任务详情，返回的是副本
+func (queue *jobQueue) get(id string) (*Job, error) {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+
+	job, ok := queue.jobs[id]
+	if !ok {
+		return nil, ErrJobNotFound
+	}
+	return job.copy(), nil
+}
+
+func (job *Job) copy() *Job {
+	dup := *job
+	dup.Items = make([]*JobItem, len(job.Items))
+	for i, item := range job.Items {
+		itemCopy := *item
+		dup.Items[i] = &itemCopy
+	}
+	return &dup
+}
+
+// 列出所有任务概要，按创建时间排序
+func (queue *jobQueue) list() []*JobSummary {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+
+	summaries := make([]*JobSummary, 0, len(queue.jobs))
+	for _, job := range queue.jobs {
+		summary := JobSummary{Id: job.Id, CreatedAt: job.CreatedAt, FinishedAt: job.FinishedAt, Counts: make(map[JobStatus]int)}
+		for _, item := range job.Items {
+			summary.Counts[item.Status]++
+		}
+		summaries = append(summaries, &summary)
+	}
+	sort.Slice(summaries, func(i, j int) bool { return summaries[i].CreatedAt.Before(summaries[j].CreatedAt) })
+	return summaries
+}
+
+// 取消任务，尚未开始的文件不再上传，正在上传的文件会被中止，状态在上传返回后变为 canceled
+// 取消前已经上传完成的文件状态仍为 done
+func (queue *jobQueue) cancel(id string) (*Job, error) {
+	queue.lock.Lock()
+	job, ok := queue.jobs[id]
+	if !ok {
+		queue.lock.Unlock()
+		return nil, ErrJobNotFound
+	}
+	if job.finished() {
+		queue.lock.Unlock()
+		return nil, ErrJobFinished
+	}
+	for _, item := range job.Items {
+		if item.Status == JobPending {
+			item.Status = JobCanceled
+		}
+	}
+	job.cancel()
+	if job.finished() {
+		job.FinishedAt = time.Now()
+	}
+	dup := job.copy()
+	queue.lock.Unlock()
+
+	queue.persist()
+	return dup, nil
+}
+
+// 停止所有 worker，并等待正在上传的文件完成，ctx 超时后不再等待
+// 未开始的文件保持 pending 状态，未完成的文件保持 running 状态，均会被持久化，下次启动时重新上传
+func (queue *jobQueue) close(ctx context.Context) error {
+	queue.lock.Lock()
+	queue.closed = true
+	queue.cond.Broadcast()
+	queue.lock.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		queue.workersWg.Wait()
+		close(done)
+	}()
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	close(queue.stopPersist)
+	queue.persisterWg.Wait()
+	queue.persist()
+	return err
+}
+
+// 获取所有尚未完成的文件
+func (queue *jobQueue) unfinished() []*UnfinishedJobItem {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+
+	var items []*UnfinishedJobItem
+	for _, job := range queue.jobs {
+		for _, item := range job.Items {
+			if item.Status == JobPending || item.Status == JobRunning {
+				items = append(items, &UnfinishedJobItem{JobId: job.Id, JobItem: *item})
+			}
+		}
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].JobId < items[j].JobId || items[i].JobId == items[j].JobId && items[i].Path < items[j].Path
+	})
+	return items
+}
+
+func (queue *jobQueue) load() error {
+	if queue.persistPath == "" {
+		return nil
+	}
+	raw, err := ioutil.ReadFile(queue.persistPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	var jobs []*Job
+	if err = json.Unmarshal(raw, &jobs); err != nil {
+		return err
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].CreatedAt.Before(jobs[j].CreatedAt) })
+	for _, job := range jobs {
+		for _, item := range job.Items {
+			// 进程退出时正在上传的文件需要重新上传
+			if item.Status == JobRunning {
+				item.Status = JobPending
+			}
+		}
+		job.initContext()
+		queue.jobs[job.Id] = job
+		queue.enqueue(job)
+	}
+	return nil
+}
+
+// 标记任务状态已经改变，由 persistLoop 合并写入；后台写入已经停止时直接写入
+func (queue *jobQueue) markDirty() {
+	if queue.persistPath == "" {
+		return
+	}
+	select {
+	case <-queue.stopPersist:
+		queue.persist()
+		return
+	default:
+	}
+	select {
+	case queue.dirty <- struct{}{}:
+	default:
+	}
+}
+
+func (queue *jobQueue) persistLoop() {
+	defer queue.persisterWg.Done()
+	for {
+		select {
+		case <-queue.dirty:
+		case <-queue.stopPersist:
+			return
+		}
+		timer := time.NewTimer(queue.persistInterval)
+		select {
+		case <-timer.C:
+		case <-queue.stopPersist:
+			// close 停止后台写入后会再写入一次
+			timer.Stop()
+			return
+		}
+		queue.persist()
+	}
+}
+
+func (queue *jobQueue) persist() {
+	if queue.persistPath == "" {
+		return
+	}
+	queue.persistLock.Lock()
+	defer queue.persistLock.Unlock()
+
+	queue.lock.Lock()
+	jobs := make([]*Job, 0, len(queue.jobs))
+	for _, job := range queue.jobs {
+		jobs = append(jobs, job)
+	}
+	raw, err := json.Marshal(jobs)
+	queue.lock.Unlock()
+	if err != nil {
+		elog.Warn("marshal jobs failed:", err)
+		return
+	}
+
+	if err = writeFileAtomically(queue.persistPath, raw); err != nil {
+		elog.Warn("persist jobs failed:", queue.persistPath, err)
+	}
+}
+
+func writeFileAtomically(path string, data []byte) error {
+	tmpFile, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err = tmpFile.Write(data); err != nil {
+		tmpFile.Close()
+		os.Remove(tmpFile.Name())
+		return err
+	}
+	if err = tmpFile.Close(); err != nil {
+		os.Remove(tmpFile.Name())
+		return err
+	}
+	return os.Rename(tmpFile.Name(), path)
+}
+
+func newJobId() (string, error) {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
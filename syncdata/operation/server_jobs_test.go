@@ -0,0 +1,180 @@
+package operation
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func waitForJob(t *testing.T, queue *jobQueue, id string) *Job {
+	for i := 0; i < 100; i++ {
+		job, err := queue.get(id)
+		assert.NoError(t, err)
+		if job.finished() {
+			return job
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("job is not finished in time")
+	return nil
+}
+
+func TestJobQueue(t *testing.T) {
+	queue, err := newJobQueue("", 2, func(ctx context.Context, req Req) error {
+		if req.Path == "bad" {
+			return errors.New("upload failed")
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+	queue.start()
+	defer queue.close(context.Background())
+
+	id, err := queue.submit([]Req{{Path: "good"}, {Path: "bad"}})
+	assert.NoError(t, err)
+	job := waitForJob(t, queue, id)
+	assert.Equal(t, job.Items[0].Status, JobDone)
+	assert.Equal(t, job.Items[1].Status, JobFailed)
+	assert.Equal(t, job.Items[1].Error, "upload failed")
+	assert.False(t, job.FinishedAt.IsZero())
+
+	_, err = queue.cancel(id)
+	assert.Equal(t, err, ErrJobFinished)
+	_, err = queue.get("not-exists")
+	assert.Equal(t, err, ErrJobNotFound)
+
+	summaries := queue.list()
+	assert.Len(t, summaries, 1)
+	assert.Equal(t, summaries[0].Counts[JobDone], 1)
+	assert.Equal(t, summaries[0].Counts[JobFailed], 1)
+}
+
+func TestJobQueuePersistAndCancel(t *testing.T) {
+	dirPath, err := ioutil.TempDir("", "jobs")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dirPath)
+	persistPath := filepath.Join(dirPath, "jobs.json")
+
+	queue, err := newJobQueue(persistPath, 1, func(ctx context.Context, req Req) error { return nil })
+	assert.NoError(t, err)
+	id1, err := queue.submit([]Req{{Path: "1"}, {Path: "2"}})
+	assert.NoError(t, err)
+	id2, err := queue.submit([]Req{{Path: "3"}})
+	assert.NoError(t, err)
+	job, err := queue.cancel(id2)
+	assert.NoError(t, err)
+	assert.Equal(t, job.Items[0].Status, JobCanceled)
+
+	processed := make(chan string, 3)
+	queue, err = newJobQueue(persistPath, 1, func(ctx context.Context, req Req) error {
+		processed <- req.Path
+		return nil
+	})
+	assert.NoError(t, err)
+	queue.start()
+	defer queue.close(context.Background())
+
+	job = waitForJob(t, queue, id1)
+	assert.Equal(t, job.Items[0].Status, JobDone)
+	assert.Equal(t, job.Items[1].Status, JobDone)
+	assert.Equal(t, <-processed, "1")
+	assert.Equal(t, <-processed, "2")
+	assert.Len(t, processed, 0)
+
+	job, err = queue.get(id2)
+	assert.NoError(t, err)
+	assert.Equal(t, job.Items[0].Status, JobCanceled)
+}
+
+func TestJobQueueCloseTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	queue, err := newJobQueue("", 1, func(ctx context.Context, req Req) error {
+		<-release
+		return nil
+	})
+	assert.NoError(t, err)
+	queue.start()
+
+	_, err = queue.submit([]Req{{Path: "1"}, {Path: "2"}})
+	assert.NoError(t, err)
+	time.Sleep(50 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, queue.close(ctx), context.DeadlineExceeded)
+	unfinished := queue.unfinished()
+	assert.Len(t, unfinished, 2)
+	assert.Equal(t, unfinished[0].Status, JobRunning)
+	assert.Equal(t, unfinished[1].Status, JobPending)
+
+	_, err = queue.submit([]Req{{Path: "3"}})
+	assert.Equal(t, err, ErrJobsClosed)
+}
+
+func TestJobQueueCancelRunning(t *testing.T) {
+	started := make(chan struct{})
+	queue, err := newJobQueue("", 1, func(ctx context.Context, req Req) error {
+		close(started)
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	assert.NoError(t, err)
+	queue.start()
+	defer queue.close(context.Background())
+
+	id, err := queue.submit([]Req{{Path: "1"}, {Path: "2"}})
+	assert.NoError(t, err)
+	<-started
+	job, err := queue.cancel(id)
+	assert.NoError(t, err)
+	assert.Equal(t, job.Items[0].Status, JobRunning)
+	assert.Equal(t, job.Items[1].Status, JobCanceled)
+
+	job = waitForJob(t, queue, id)
+	assert.Equal(t, job.Items[0].Status, JobCanceled)
+	assert.Equal(t, job.Items[0].Error, context.Canceled.Error())
+	assert.False(t, job.FinishedAt.IsZero())
+}
+
+func TestJobQueueBatchPersist(t *testing.T) {
+	dirPath, err := ioutil.TempDir("", "jobs")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dirPath)
+	persistPath := filepath.Join(dirPath, "jobs.json")
+
+	queue, err := newJobQueue(persistPath, 2, func(ctx context.Context, req Req) error { return nil })
+	assert.NoError(t, err)
+	queue.persistInterval = time.Hour
+	queue.start()
+
+	reqs := make([]Req, 100)
+	for i := range reqs {
+		reqs[i].Path = strconv.Itoa(i)
+	}
+	id, err := queue.submit(reqs)
+	assert.NoError(t, err)
+	waitForJob(t, queue, id)
+
+	// 后台写入尚未到时间，文件中仍是提交时的状态
+	loaded, err := newJobQueue(persistPath, 1, nil)
+	assert.NoError(t, err)
+	job, err := loaded.get(id)
+	assert.NoError(t, err)
+	assert.Equal(t, job.Items[99].Status, JobPending)
+
+	assert.NoError(t, queue.close(context.Background()))
+	loaded, err = newJobQueue(persistPath, 1, nil)
+	assert.NoError(t, err)
+	job, err = loaded.get(id)
+	assert.NoError(t, err)
+	assert.True(t, job.finished())
+	assert.Equal(t, job.Items[99].Status, JobDone)
+}
@@ -0,0 +1,205 @@
+package operation
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/qiniupd/qiniu-go-sdk/x/httputil.v1"
+)
+
+var (
+	errInvalidSeekWhence = errors.New("invalid seek whence")
+	errNegativePosition  = errors.New("negative position")
+)
+
+type transferReq struct {
+	From   string `json:"from"`
+	To     string `json:"to"`
+	Bucket string `json:"bucket"`
+}
+
+type errorRet struct {
+	Error string `json:"error"`
+}
+
+// 根据错误推断返回给客户端的 HTTP 状态码
+func errorStatusCode(err error) int {
+	switch err {
+	case ErrUndefinedConfig, ErrCannotTransferBetweenDifferentClusters:
+		return http.StatusBadRequest
+	case ErrPathNotAllowed:
+		return http.StatusForbidden
+	case ErrJobNotFound, ErrObjectNotFound:
+		return http.StatusNotFound
+	case ErrJobFinished:
+		return http.StatusConflict
+	case ErrJobsClosed:
+		return http.StatusServiceUnavailable
+	}
+	switch code := httputil.DetectCode(err); {
+	case code == 612 || code == 631:
+		return http.StatusNotFound
+	case code == 614:
+		return http.StatusConflict
+	case code == 499:
+		return 499
+	case code >= 400 && code < 500:
+		return code
+	default:
+		return http.StatusBadGateway
+	}
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	log.Println("reply error", code, err)
+	writeJson(w, code, &errorRet{Error: err.Error()})
+}
+
+func (s *server) serveObjects(w http.ResponseWriter, r *http.Request) {
+	// 对象名不以 / 开头，与上传时保存的对象名一致
+	key := strings.TrimPrefix(r.URL.Path, "/objects/")
+	if key == "" {
+		writeError(w, http.StatusBadRequest, errors.New("empty key"))
+		return
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		s.getObject(w, r, key)
+	case http.MethodDelete:
+		s.deleteObject(w, r, key)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+	}
+}
+
+func (s *server) getObject(w http.ResponseWriter, r *http.Request, key string) {
+	stats, err := s.lister.listStat(r.Context(), []string{key})
+	if err != nil {
+		writeError(w, errorStatusCode(err), err)
+		return
+	}
+	if stats[0].code != http.StatusOK {
+		if stats[0].code == 612 {
+			writeError(w, http.StatusNotFound, ErrObjectNotFound)
+		} else {
+			writeError(w, http.StatusBadGateway, errors.New("stat object failed"))
+		}
+		return
+	}
+	content := objectReadSeeker{downloader: s.down, key: key, size: stats[0].Size}
+	defer content.Close()
+	ServeContent(w, r, key, time.Time{}, &content)
+}
+
+func (s *server) deleteObject(w http.ResponseWriter, r *http.Request, key string) {
+	if err := s.lister.Delete(key); err != nil {
+		writeError(w, errorStatusCode(err), err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *server) decodeTransferReq(w http.ResponseWriter, r *http.Request) (*transferReq, bool) {
+	var req transferReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return nil, false
+	}
+	if req.From == "" || req.To == "" {
+		writeError(w, http.StatusBadRequest, errors.New("from and to must not be empty"))
+		return nil, false
+	}
+	return &req, true
+}
+
+func (s *server) copyObject(w http.ResponseWriter, r *http.Request) {
+	req, ok := s.decodeTransferReq(w, r)
+	if !ok {
+		return
+	}
+	if err := s.lister.Copy(req.From, req.To); err != nil {
+		writeError(w, errorStatusCode(err), err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *server) moveObject(w http.ResponseWriter, r *http.Request) {
+	req, ok := s.decodeTransferReq(w, r)
+	if !ok {
+		return
+	}
+	var err error
+	if req.Bucket != "" {
+		err = s.lister.MoveTo(req.From, req.Bucket, req.To)
+	} else {
+		err = s.lister.Rename(req.From, req.To)
+	}
+	if err != nil {
+		writeError(w, errorStatusCode(err), err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// 以 io.ReadSeeker 的方式访问远端对象，每次 Seek 后从新的位置重新发起 Range 请求
+type objectReadSeeker struct {
+	downloader *Downloader
+	key        string
+	size       int64
+	offset     int64
+	body       io.ReadCloser
+}
+
+func (r *objectReadSeeker) Read(p []byte) (int, error) {
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+	if r.body == nil {
+		_, body, err := r.downloader.DownloadRangeReader(r.key, r.offset, -1)
+		if err != nil {
+			return 0, err
+		}
+		r.body = body
+	}
+	n, err := r.body.Read(p)
+	r.offset += int64(n)
+	if err == io.EOF && r.offset < r.size {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (r *objectReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, errInvalidSeekWhence
+	}
+	if offset < 0 {
+		return 0, errNegativePosition
+	}
+	if offset != r.offset {
+		r.Close()
+		r.offset = offset
+	}
+	return offset, nil
+}
+
+func (r *objectReadSeeker) Close() error {
+	if r.body != nil {
+		err := r.body.Close()
+		r.body = nil
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package operation
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/qiniupd/qiniu-go-sdk/x/rpc.v7"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestErrorStatusCode(t *testing.T) {
+	assert.Equal(t, errorStatusCode(ErrPathNotAllowed), http.StatusForbidden)
+	assert.Equal(t, errorStatusCode(ErrJobNotFound), http.StatusNotFound)
+	assert.Equal(t, errorStatusCode(ErrObjectNotFound), http.StatusNotFound)
+	assert.Equal(t, errorStatusCode(ErrJobFinished), http.StatusConflict)
+	assert.Equal(t, errorStatusCode(ErrCannotTransferBetweenDifferentClusters), http.StatusBadRequest)
+	assert.Equal(t, errorStatusCode(&rpc.ErrorInfo{Code: 612}), http.StatusNotFound)
+	assert.Equal(t, errorStatusCode(&rpc.ErrorInfo{Code: 614}), http.StatusConflict)
+	assert.Equal(t, errorStatusCode(&rpc.ErrorInfo{Code: 401}), http.StatusUnauthorized)
+	assert.Equal(t, errorStatusCode(&rpc.ErrorInfo{Code: 500}), http.StatusBadGateway)
+}
+
+// 模拟 rs 的 batch stat、delete 以及 io 的下载接口，存储空间中只有一个对象
+func newFakeObjectBackend(key, content string, deleted *[]string) *httptest.Server {
+	decodeEntry := func(encoded string) string {
+		entry, _ := base64.URLEncoding.DecodeString(encoded)
+		return strings.TrimPrefix(string(entry), "bucket:")
+	}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/batch":
+			r.ParseForm()
+			rets := make([]map[string]interface{}, 0, len(r.Form["op"]))
+			for _, op := range r.Form["op"] {
+				if decodeEntry(strings.TrimPrefix(op, "/stat/")) == key {
+					rets = append(rets, map[string]interface{}{"code": 200, "data": map[string]interface{}{"fsize": len(content)}})
+				} else {
+					rets = append(rets, map[string]interface{}{"code": 612, "data": map[string]interface{}{"error": "no such file or directory"}})
+				}
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(rets)
+		case strings.HasPrefix(r.URL.Path, "/delete/"):
+			deletedKey := decodeEntry(strings.TrimPrefix(r.URL.Path, "/delete/"))
+			w.Header().Set("Content-Type", "application/json")
+			if deletedKey != key {
+				w.WriteHeader(612)
+				json.NewEncoder(w).Encode(map[string]string{"error": "no such file or directory"})
+				return
+			}
+			*deleted = append(*deleted, deletedKey)
+			w.Write([]byte("{}"))
+		case r.URL.Path == "/getfile/ak/bucket/"+key:
+			http.ServeContent(w, r, key, time.Time{}, strings.NewReader(content))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+}
+
+func TestServeObjects(t *testing.T) {
+	var deleted []string
+	backend := newFakeObjectBackend("dir/key", "hello world", &deleted)
+	defer backend.Close()
+
+	cfg := &Config{Bucket: "bucket", Ak: "ak", Sk: "sk", RsHosts: []string{backend.URL}, IoHosts: []string{backend.URL}}
+	guard, err := newServerGuard(&Config{})
+	assert.NoError(t, err)
+	s := &server{lister: NewLister(cfg), down: NewDownloader(cfg), guard: guard}
+	serve := func(method, path string, header http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, req)
+		return w
+	}
+
+	w := serve(http.MethodGet, "/objects/dir/key", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "hello world", w.Body.String())
+
+	w = serve(http.MethodHead, "/objects/dir/key", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "11", w.Header().Get("Content-Length"))
+
+	w = serve(http.MethodGet, "/objects/dir/key", http.Header{"Range": {"bytes=6-"}})
+	assert.Equal(t, http.StatusPartialContent, w.Code)
+	assert.Equal(t, "bytes 6-10/11", w.Header().Get("Content-Range"))
+	body, _ := ioutil.ReadAll(w.Body)
+	assert.Equal(t, "world", string(body))
+
+	w = serve(http.MethodGet, "/objects/dir/missing", nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = serve(http.MethodGet, "/objects/", nil)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = serve(http.MethodDelete, "/objects/dir/key", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, []string{"dir/key"}, deleted)
+
+	w = serve(http.MethodDelete, "/objects/dir/missing", nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
@@ -0,0 +1,28 @@
+package operation
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServerShutdown(t *testing.T) {
+	svr, err := StartServer(&Config{Addr: "127.0.0.1:0", Sim: true})
+	assert.NoError(t, err)
+
+	_, err = StartServer(&Config{Addr: svr.Addr().String(), Sim: true})
+	assert.Error(t, err)
+
+	resp, err := http.Get("http://" + svr.Addr().String() + "/jobs")
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, resp.StatusCode, http.StatusOK)
+
+	report, err := svr.Shutdown(context.Background())
+	assert.NoError(t, err)
+	assert.Empty(t, report.Unfinished)
+	_, ok := <-svr.Err()
+	assert.False(t, ok)
+}
@@ -0,0 +1,221 @@
+package operation
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	q "github.com/qiniupd/qiniu-go-sdk/api.v8/kodocli"
+)
+
+const defaultSyncConcurrency = 4
+
+// 前缀为空时删除远端多余的对象会删除整个存储空间中的对象
+var ErrSyncDeleteEmptyPrefix = errors.New("sync with delete requires a non-empty prefix")
+
+// 目录同步选项
+type SyncOptions struct {
+	// 并发上传的文件数，默认为 4
+	Concurrency int
+	// 是否删除远端存在但本地已经不存在的对象，这时前缀不能为空
+	Delete bool
+}
+
+// 同步失败的文件或对象
+type SyncError struct {
+	Key string
+	Err error
+}
+
+func (e *SyncError) Error() string {
+	return e.Key + ": " + e.Err.Error()
+}
+
+// 目录同步结果
+type SyncResult struct {
+	Uploaded      int
+	UploadedBytes int64
+	Skipped       int
+	Deleted       int
+	Failed        []*SyncError
+}
+
+func (r *SyncResult) String() string {
+	return fmt.Sprintf("uploaded: %d (%d bytes), skipped: %d, deleted: %d, failed: %d",
+		r.Uploaded, r.UploadedBytes, r.Skipped, r.Deleted, len(r.Failed))
+}
+
+type syncFile struct {
+	path string
+	key  string
+	size int64
+}
+
+// 将本地目录同步到存储空间的指定前缀下，对象名为前缀加上文件相对于目录的路径，前缀不以 / 结尾时会自动补上
+// 远端对象大小和 etag 与本地文件一致时跳过上传，单个文件失败不会中断同步，失败的文件记录在结果中
+func SyncDir(ctx context.Context, uploader *Uploader, lister *Lister, dir, prefix string, options *SyncOptions) (*SyncResult, error) {
+	if options == nil {
+		options = &SyncOptions{}
+	}
+	if prefix == "" && options.Delete {
+		return nil, ErrSyncDeleteEmptyPrefix
+	}
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	concurrency := options.Concurrency
+	if concurrency <= 0 {
+		concurrency = defaultSyncConcurrency
+	}
+
+	files, walkFailed := walkSyncDir(dir, prefix)
+	keys := make([]string, len(files))
+	for i, file := range files {
+		keys[i] = file.key
+	}
+	stats, err := lister.listStat(ctx, keys)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		result     = SyncResult{Failed: walkFailed}
+		resultLock sync.Mutex
+		pool       = newGoroutinePool(concurrency)
+	)
+	fail := func(key string, err error) {
+		elog.Warn("sync failed:", key, err)
+		resultLock.Lock()
+		result.Failed = append(result.Failed, &SyncError{Key: key, Err: err})
+		resultLock.Unlock()
+	}
+	for i := range files {
+		func(file *syncFile, stat *FileStat) {
+			pool.Go(func(ctx context.Context) error {
+				if err := ctx.Err(); err != nil {
+					fail(file.key, err)
+					return nil
+				}
+				if needed, err := needSync(file, stat); err != nil {
+					fail(file.key, err)
+					return nil
+				} else if !needed {
+					resultLock.Lock()
+					result.Skipped++
+					resultLock.Unlock()
+					return nil
+				}
+				if err := uploader.Upload(file.path, file.key); err != nil {
+					fail(file.key, err)
+					return nil
+				}
+				resultLock.Lock()
+				result.Uploaded++
+				result.UploadedBytes += file.size
+				resultLock.Unlock()
+				return nil
+			})
+		}(files[i], stats[i])
+	}
+	if err = pool.Wait(ctx); err != nil {
+		return &result, err
+	}
+
+	if options.Delete {
+		if err = syncDelete(ctx, lister, prefix, keys, walkFailed, concurrency, &result, fail); err != nil {
+			return &result, err
+		}
+	}
+	return &result, ctx.Err()
+}
+
+// 遍历失败的文件或目录下的对象不会被删除，因为无法确定它们在本地是否存在
+func syncDelete(ctx context.Context, lister *Lister, prefix string, localKeys []string, walkFailed []*SyncError, concurrency int,
+	result *SyncResult, fail func(string, error)) error {
+	remoteKeys, err := lister.listPrefix(ctx, prefix)
+	if err != nil {
+		return err
+	}
+	localKeysSet := make(map[string]struct{}, len(localKeys))
+	for _, key := range localKeys {
+		localKeysSet[key] = struct{}{}
+	}
+
+	var (
+		resultLock sync.Mutex
+		pool       = newGoroutinePool(concurrency)
+	)
+	for _, key := range remoteKeys {
+		if _, exists := localKeysSet[key]; exists || underFailedPath(key, walkFailed) {
+			continue
+		}
+		func(key string) {
+			pool.Go(func(ctx context.Context) error {
+				if err := ctx.Err(); err != nil {
+					fail(key, err)
+				} else if err = lister.Delete(key); err != nil {
+					fail(key, err)
+				} else {
+					resultLock.Lock()
+					result.Deleted++
+					resultLock.Unlock()
+				}
+				return nil
+			})
+		}(key)
+	}
+	return pool.Wait(ctx)
+}
+
+// 遍历本地目录，无法访问的文件或目录记录在失败列表中，不会中断遍历
+func walkSyncDir(dir, prefix string) ([]*syncFile, []*SyncError) {
+	var (
+		files  []*syncFile
+		failed []*SyncError
+	)
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		key := prefix
+		if rel, relErr := filepath.Rel(dir, path); relErr != nil {
+			key += filepath.ToSlash(path)
+			if err == nil {
+				err = relErr
+			}
+		} else if rel != "." {
+			key += filepath.ToSlash(rel)
+		}
+		if err != nil {
+			elog.Warn("sync failed:", key, err)
+			failed = append(failed, &SyncError{Key: key, Err: err})
+			return nil
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		files = append(files, &syncFile{path: path, key: key, size: info.Size()})
+		return nil
+	})
+	return files, failed
+}
+
+// 对象是否是遍历失败的文件本身，或位于遍历失败的目录下
+func underFailedPath(key string, failed []*SyncError) bool {
+	for _, f := range failed {
+		if key == f.Key || strings.HasPrefix(key, strings.TrimSuffix(f.Key, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// 远端对象不存在，或大小、etag 与本地文件不一致时需要上传
+func needSync(file *syncFile, stat *FileStat) (bool, error) {
+	identical, err := identicalObject(stat, file.size, func() (string, error) { return q.GetFileEtag(file.path) })
+	if err != nil {
+		return false, err
+	}
+	return !identical, nil
+}
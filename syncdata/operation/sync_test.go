@@ -0,0 +1,67 @@
+package operation
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWalkSyncDirAndNeedSync(t *testing.T) {
+	dirPath, err := ioutil.TempDir("", "sync")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dirPath)
+
+	assert.NoError(t, os.MkdirAll(filepath.Join(dirPath, "a", "b"), 0755))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dirPath, "1.txt"), []byte("etag"), 0644))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dirPath, "a", "b", "2.txt"), []byte("22"), 0644))
+
+	files, failed := walkSyncDir(dirPath, "prefix/")
+	assert.Empty(t, failed)
+	assert.Len(t, files, 2)
+	assert.Equal(t, files[0].key, "prefix/1.txt")
+	assert.Equal(t, files[1].key, "prefix/a/b/2.txt")
+	assert.Equal(t, files[1].size, int64(2))
+
+	needed, err := needSync(files[0], &FileStat{code: 612})
+	assert.NoError(t, err)
+	assert.True(t, needed)
+	needed, err = needSync(files[0], &FileStat{Size: 5, code: 200})
+	assert.NoError(t, err)
+	assert.True(t, needed)
+	needed, err = needSync(files[0], &FileStat{Size: 4, Hash: "FpLiADEaVoALPkdb8tJEJyRTXoe_", code: 200})
+	assert.NoError(t, err)
+	assert.False(t, needed)
+	needed, err = needSync(files[0], &FileStat{Size: 4, Hash: "other", code: 200})
+	assert.NoError(t, err)
+	assert.True(t, needed)
+	_, err = needSync(files[0], &FileStat{code: 599})
+	assert.Error(t, err)
+}
+
+func TestWalkSyncDirFailure(t *testing.T) {
+	dirPath, err := ioutil.TempDir("", "sync")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dirPath)
+
+	files, failed := walkSyncDir(filepath.Join(dirPath, "missing"), "prefix/")
+	assert.Empty(t, files)
+	assert.Len(t, failed, 1)
+	assert.Equal(t, "prefix/", failed[0].Key)
+	assert.True(t, os.IsNotExist(failed[0].Err))
+
+	assert.True(t, underFailedPath("prefix/a/1.txt", failed))
+	failed = []*SyncError{{Key: "prefix/a"}}
+	assert.True(t, underFailedPath("prefix/a", failed))
+	assert.True(t, underFailedPath("prefix/a/1.txt", failed))
+	assert.False(t, underFailedPath("prefix/ab", failed))
+	assert.False(t, underFailedPath("prefix/b/1.txt", failed))
+}
+
+func TestSyncDirDeleteRequiresPrefix(t *testing.T) {
+	_, err := SyncDir(context.Background(), nil, nil, ".", "", &SyncOptions{Delete: true})
+	assert.Equal(t, ErrSyncDeleteEmptyPrefix, err)
+}
@@ -3,7 +3,6 @@ package operation
 import (
 	"bufio"
 	"bytes"
-	"context"
 	"encoding/json"
 	"io"
 	"io/ioutil"
@@ -14,6 +13,8 @@ import (
 	"github.com/qiniupd/qiniu-go-sdk/api.v7/auth/qbox"
 	"github.com/qiniupd/qiniu-go-sdk/api.v8/kodo"
 	q "github.com/qiniupd/qiniu-go-sdk/api.v8/kodocli"
+	"github.com/qiniupd/qiniu-go-sdk/api.v8/limit"
+	"github.com/qiniupd/qiniu-go-sdk/x/httputil.v1"
 )
 
 // 上传器
@@ -41,63 +42,103 @@ func NewUploaderV2() *Uploader {
 
 // 上传内存数据到指定对象中
 func (p *Uploader) UploadData(data []byte, key string) (err error) {
-	if p.singleClusterUploader != nil {
-		return p.singleClusterUploader.uploadData(data, key)
-	}
-	if config, exists := p.config.forKey(key); !exists {
-		return ErrUndefinedConfig
-	} else {
-		return newSingleClusterUploader(config).uploadData(data, key)
+	_, err = p.UploadDataWithOptions(data, key, nil)
+	return
+}
+
+// 上传内存数据到指定对象中，options 可以为 nil，返回结果中包含是否实际进行了上传
+func (p *Uploader) UploadDataWithOptions(data []byte, key string, options *UploadOptions) (*UploadResult, error) {
+	uploader, err := p.uploaderForKey(key)
+	if err != nil {
+		return nil, err
 	}
+	etag := func() (string, error) { return q.GetEtag(bytes.NewReader(data)) }
+	return uploader.conditionalUpload(key, int64(len(data)), options, etag, func() error {
+		return uploader.uploadData(data, key, options)
+	})
 }
 
 // 从 Reader 中阅读指定大小的数据并上传到指定对象中
 func (p *Uploader) UploadDataReader(data io.ReaderAt, size int, key string) (err error) {
-	if p.singleClusterUploader != nil {
-		return p.singleClusterUploader.uploadDataReader(data, size, key)
-	}
-	if config, exists := p.config.forKey(key); !exists {
-		return ErrUndefinedConfig
-	} else {
-		return newSingleClusterUploader(config).uploadDataReader(data, size, key)
+	_, err = p.UploadDataReaderWithOptions(data, size, key, nil)
+	return
+}
+
+// 从 Reader 中阅读指定大小的数据并上传到指定对象中，options 可以为 nil，返回结果中包含是否实际进行了上传
+func (p *Uploader) UploadDataReaderWithOptions(data io.ReaderAt, size int, key string, options *UploadOptions) (*UploadResult, error) {
+	uploader, err := p.uploaderForKey(key)
+	if err != nil {
+		return nil, err
 	}
+	etag := func() (string, error) { return q.GetEtag(io.NewSectionReader(data, 0, int64(size))) }
+	return uploader.conditionalUpload(key, int64(size), options, etag, func() error {
+		return uploader.uploadDataReader(data, size, key, options)
+	})
 }
 
 // 上传指定文件到指定对象中
 func (p *Uploader) Upload(file string, key string) (err error) {
-	if p.singleClusterUploader != nil {
-		return p.singleClusterUploader.upload(file, key)
+	_, err = p.UploadWithOptions(file, key, nil)
+	return
+}
+
+// 上传指定文件到指定对象中，options 可以为 nil，返回结果中包含是否实际进行了上传
+func (p *Uploader) UploadWithOptions(file string, key string, options *UploadOptions) (*UploadResult, error) {
+	uploader, err := p.uploaderForKey(key)
+	if err != nil {
+		return nil, err
 	}
-	if config, exists := p.config.forKey(key); !exists {
-		return ErrUndefinedConfig
-	} else {
-		return newSingleClusterUploader(config).upload(file, key)
+	info, err := os.Stat(file)
+	if err != nil {
+		return nil, err
 	}
+	etag := func() (string, error) { return q.GetFileEtag(file) }
+	return uploader.conditionalUpload(key, info.Size(), options, etag, func() error {
+		return uploader.upload(file, key, options)
+	})
 }
 
 // 从 Reader 中阅读全部数据并上传到指定对象中
 func (p *Uploader) UploadReader(reader io.Reader, key string) (err error) {
+	_, err = p.UploadReaderWithOptions(reader, key, nil)
+	return
+}
+
+// 从 Reader 中阅读全部数据并上传到指定对象中，options 可以为 nil，返回结果中包含是否实际进行了上传
+func (p *Uploader) UploadReaderWithOptions(reader io.Reader, key string, options *UploadOptions) (*UploadResult, error) {
+	uploader, err := p.uploaderForKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return uploader.conditionalUpload(key, -1, options, nil, func() error {
+		return uploader.uploadReader(reader, key, options)
+	})
+}
+
+func (p *Uploader) uploaderForKey(key string) (*singleClusterUploader, error) {
 	if p.singleClusterUploader != nil {
-		return p.singleClusterUploader.uploadReader(reader, key)
+		return p.singleClusterUploader, nil
 	}
 	if config, exists := p.config.forKey(key); !exists {
-		return ErrUndefinedConfig
+		return nil, ErrUndefinedConfig
 	} else {
-		return newSingleClusterUploader(config).uploadReader(reader, key)
+		return newSingleClusterUploader(config), nil
 	}
 }
 
 type singleClusterUploader struct {
 	bucket        string
 	upHosts       []string
-	credentials   *qbox.Mac
+	credentials   CredentialsProvider
 	partSize      int64
 	upConcurrency int
+	upReadAhead   int
 	queryer       *Queryer
+	rateLimiters  []*limit.RateLimiter
+	lister        *singleClusterLister
 }
 
 func newSingleClusterUploader(c *Config) *singleClusterUploader {
-	mac := qbox.NewMac(c.Ak, c.Sk)
 	part := c.PartSize * 1024 * 1024
 	if part < 4*1024*1024 {
 		part = 4 * 1024 * 1024
@@ -111,35 +152,51 @@ func newSingleClusterUploader(c *Config) *singleClusterUploader {
 	return &singleClusterUploader{
 		bucket:        c.Bucket,
 		upHosts:       dupStrings(c.UpHosts),
-		credentials:   mac,
+		credentials:   c.credentialsProvider(),
 		partSize:      part,
 		upConcurrency: c.UpConcurrency,
+		upReadAhead:   c.UpReadAhead,
 		queryer:       queryer,
+		rateLimiters:  []*limit.RateLimiter{GlobalUpRateLimiter, c.UpRateLimiter()},
+		lister:        newSingleClusterLister(c),
 	}
 }
 
-func (p *singleClusterUploader) makeUptoken(policy *kodo.PutPolicy) string {
+func (p *singleClusterUploader) makeUptoken(policy *kodo.PutPolicy) (string, error) {
 	var rr = *policy
 	if rr.Expires == 0 {
 		rr.Expires = 3600 + uint32(time.Now().Unix())
 	}
+	mac, err := p.credentials.Get()
+	if err != nil {
+		return "", err
+	}
 	b, _ := json.Marshal(&rr)
-	return qbox.SignWithData(p.credentials, b)
+	return qbox.SignWithData(mac, b), nil
+}
+
+// 每次调用都重新签发上传凭证，用于耗时可能超过凭证有效期的分片上传
+func (p *singleClusterUploader) uptokenSource(key string, options *UploadOptions) q.UptokenSource {
+	return func() (string, error) {
+		return p.makeUptoken(options.putPolicy(p.bucket, key))
+	}
 }
 
-func (p *singleClusterUploader) uploadData(data []byte, key string) (err error) {
+func (p *singleClusterUploader) uploadData(data []byte, key string, options *UploadOptions) (err error) {
+	hostBytes := newUploadHostBytes()
 	t := time.Now()
 	defer func() {
 		elog.Info("up time ", key, time.Now().Sub(t))
+		DefaultMetrics.recordOperation("upload_data", t, err)
+		hostBytes.record(DefaultMetrics, "upload_data", err == nil)
 	}()
 	key = strings.TrimPrefix(key, "/")
-	policy := kodo.PutPolicy{
-		Scope:   p.bucket + ":" + key,
-		Expires: 3600*24 + uint32(time.Now().Unix()),
+	ctx := options.context()
+	upToken, err := p.makeUptoken(options.putPolicy(p.bucket, key))
+	if err != nil {
+		return err
 	}
 
-	upToken := p.makeUptoken(&policy)
-
 	upHosts := p.upHosts
 	if p.queryer != nil {
 		if hosts := p.queryer.QueryUpHosts(false); len(hosts) > 0 {
@@ -151,30 +208,44 @@ func (p *singleClusterUploader) uploadData(data []byte, key string) (err error)
 		UpHosts:        upHosts,
 		UploadPartSize: p.partSize,
 		Concurrency:    p.upConcurrency,
+		RateLimiters:   p.rateLimiters,
+		VerifyEtag:     true,
 	})
+	tracker := newUploadProgressTracker(key, int64(len(data)), options)
+	tracker.attach(&uploader)
+	hostBytes.attach(&uploader)
 	for i := 0; i < 3; i++ {
-		err = uploader.Put2(context.Background(), nil, upToken, key, bytes.NewReader(data), int64(len(data)), nil)
+		err = uploader.Put2(ctx, nil, upToken, key, bytes.NewReader(data), int64(len(data)), options.putExtra())
 		if err == nil {
+			tracker.done(int64(len(data)))
+			break
+		}
+		if ctx.Err() != nil || !uploadRetryable(err) {
 			break
 		}
 		elog.Info("small upload retry", i, err)
+		DefaultMetrics.recordRetry("upload_data")
+		tracker.retry()
+		hostBytes.reset()
 	}
 	return
 }
 
-func (p *singleClusterUploader) uploadDataReader(data io.ReaderAt, size int, key string) (err error) {
+func (p *singleClusterUploader) uploadDataReader(data io.ReaderAt, size int, key string, options *UploadOptions) (err error) {
+	hostBytes := newUploadHostBytes()
 	t := time.Now()
 	defer func() {
 		elog.Info("up time ", key, time.Now().Sub(t))
+		DefaultMetrics.recordOperation("upload_data", t, err)
+		hostBytes.record(DefaultMetrics, "upload_data", err == nil)
 	}()
 	key = strings.TrimPrefix(key, "/")
-	policy := kodo.PutPolicy{
-		Scope:   p.bucket + ":" + key,
-		Expires: 3600*24 + uint32(time.Now().Unix()),
+	ctx := options.context()
+	upToken, err := p.makeUptoken(options.putPolicy(p.bucket, key))
+	if err != nil {
+		return err
 	}
 
-	upToken := p.makeUptoken(&policy)
-
 	upHosts := p.upHosts
 	if p.queryer != nil {
 		if hosts := p.queryer.QueryUpHosts(false); len(hosts) > 0 {
@@ -186,29 +257,45 @@ func (p *singleClusterUploader) uploadDataReader(data io.ReaderAt, size int, key
 		UpHosts:        upHosts,
 		UploadPartSize: p.partSize,
 		Concurrency:    p.upConcurrency,
+		RateLimiters:   p.rateLimiters,
+		VerifyEtag:     true,
 	})
 
+	tracker := newUploadProgressTracker(key, int64(size), options)
+	tracker.attach(&uploader)
+	hostBytes.attach(&uploader)
 	for i := 0; i < 3; i++ {
-		err = uploader.Put2(context.Background(), nil, upToken, key, newReaderAtNopCloser(data), int64(size), nil)
+		err = uploader.Put2(ctx, nil, upToken, key, newReaderAtNopCloser(data), int64(size), options.putExtra())
 		if err == nil {
+			tracker.done(int64(size))
+			break
+		}
+		if ctx.Err() != nil || !uploadRetryable(err) {
 			break
 		}
 		elog.Info("small upload retry", i, err)
+		DefaultMetrics.recordRetry("upload_data")
+		tracker.retry()
+		hostBytes.reset()
 	}
 	return
 }
 
-func (p *singleClusterUploader) upload(file string, key string) (err error) {
+func (p *singleClusterUploader) upload(file string, key string, options *UploadOptions) (err error) {
+	var fileSize int64
+	hostBytes := newUploadHostBytes()
 	t := time.Now()
 	defer func() {
 		elog.Info("up time ", key, time.Now().Sub(t))
+		DefaultMetrics.recordOperation("upload_file", t, err)
+		hostBytes.record(DefaultMetrics, "upload_file", err == nil)
 	}()
 	key = strings.TrimPrefix(key, "/")
-	policy := kodo.PutPolicy{
-		Scope:   p.bucket + ":" + key,
-		Expires: 3600*24 + uint32(time.Now().Unix()),
+	ctx := options.context()
+	upToken, err := p.makeUptoken(options.putPolicy(p.bucket, key))
+	if err != nil {
+		return err
 	}
-	upToken := p.makeUptoken(&policy)
 
 	f, err := os.Open(file)
 	if err != nil {
@@ -222,6 +309,7 @@ func (p *singleClusterUploader) upload(file string, key string) (err error) {
 		elog.Info("get file stat failed: ", err)
 		return err
 	}
+	fileSize = fInfo.Size()
 
 	upHosts := p.upHosts
 	if p.queryer != nil {
@@ -234,43 +322,68 @@ func (p *singleClusterUploader) upload(file string, key string) (err error) {
 		UpHosts:        upHosts,
 		UploadPartSize: p.partSize,
 		Concurrency:    p.upConcurrency,
+		ReadAhead:      p.upReadAhead,
+		RateLimiters:   p.rateLimiters,
+		VerifyEtag:     true,
 	})
 
+	tracker := newUploadProgressTracker(key, fileSize, options)
+	tracker.attach(&uploader)
+	hostBytes.attach(&uploader)
 	if fInfo.Size() <= p.partSize {
 		for i := 0; i < 3; i++ {
-			err = uploader.Put2(context.Background(), nil, upToken, key, newReaderAtNopCloser(f), fInfo.Size(), nil)
+			err = uploader.Put2(ctx, nil, upToken, key, newReaderAtNopCloser(f), fInfo.Size(), options.putExtra())
 			if err == nil {
+				tracker.done(fileSize)
+				break
+			}
+			if ctx.Err() != nil || !uploadRetryable(err) {
 				break
 			}
 			elog.Info("small upload retry", i, err)
+			DefaultMetrics.recordRetry("upload_file")
+			tracker.retry()
+			hostBytes.reset()
 		}
 		return
 	}
 
 	for i := 0; i < 3; i++ {
-		err = uploader.Upload(context.Background(), nil, upToken, key, newReaderAtNopCloser(f), fInfo.Size(), nil,
+		err = uploader.UploadWithUptokenSource(ctx, nil, p.uptokenSource(key, options), key, newReaderAtNopCloser(f), fInfo.Size(), options.completeMultipart(),
 			func(partIdx int, etag string) {
 				elog.Info("callback", partIdx, etag)
+				tracker.partDone(partIdx, etag)
 			})
 		if err == nil {
+			tracker.done(fileSize)
+			break
+		}
+		if ctx.Err() != nil || !uploadRetryable(err) {
 			break
 		}
 		elog.Info("part upload retry", i, err)
+		DefaultMetrics.recordRetry("upload_file")
+		tracker.retry()
+		hostBytes.reset()
 	}
 	return
 }
 
-func (p *singleClusterUploader) uploadReader(reader io.Reader, key string) (err error) {
+func (p *singleClusterUploader) uploadReader(reader io.Reader, key string, options *UploadOptions) (err error) {
+	counter := countingReader{Reader: reader}
+	hostBytes := newUploadHostBytes()
 	t := time.Now()
 	defer func() {
 		elog.Info("up time ", key, time.Now().Sub(t))
+		DefaultMetrics.recordOperation("upload_reader", t, err)
+		hostBytes.record(DefaultMetrics, "upload_reader", err == nil)
 	}()
 	key = strings.TrimPrefix(key, "/")
-	policy := kodo.PutPolicy{
-		Scope:   p.bucket + ":" + key,
-		Expires: 3600*24 + uint32(time.Now().Unix()),
+	ctx := options.context()
+	upToken, err := p.makeUptoken(options.putPolicy(p.bucket, key))
+	if err != nil {
+		return err
 	}
-	upToken := p.makeUptoken(&policy)
 
 	upHosts := p.upHosts
 	if p.queryer != nil {
@@ -283,9 +396,15 @@ func (p *singleClusterUploader) uploadReader(reader io.Reader, key string) (err
 		UpHosts:        upHosts,
 		UploadPartSize: p.partSize,
 		Concurrency:    p.upConcurrency,
+		RateLimiters:   p.rateLimiters,
+		VerifyEtag:     true,
 	})
 
-	bufReader := bufio.NewReader(reader)
+	tracker := newUploadProgressTracker(key, -1, options)
+	tracker.attach(&uploader)
+	hostBytes.attach(&uploader)
+
+	bufReader := bufio.NewReader(&counter)
 	firstPart, err := ioutil.ReadAll(io.LimitReader(bufReader, p.partSize))
 	if err != nil {
 		return
@@ -303,23 +422,42 @@ func (p *singleClusterUploader) uploadReader(reader io.Reader, key string) (err
 	}
 
 	if smallUpload {
+		tracker.setTotal(int64(len(firstPart)))
 		for i := 0; i < 3; i++ {
-			err = uploader.Put2(context.Background(), nil, upToken, key, bytes.NewReader(firstPart), int64(len(firstPart)), nil)
+			err = uploader.Put2(ctx, nil, upToken, key, bytes.NewReader(firstPart), int64(len(firstPart)), options.putExtra())
 			if err == nil {
+				tracker.done(int64(len(firstPart)))
+				break
+			}
+			if ctx.Err() != nil || !uploadRetryable(err) {
 				break
 			}
 			elog.Info("small upload retry", i, err)
+			DefaultMetrics.recordRetry("upload_reader")
+			tracker.retry()
+			hostBytes.reset()
 		}
 		return
 	}
 
-	err = uploader.StreamUpload(context.Background(), nil, upToken, key, io.MultiReader(bytes.NewReader(firstPart), bufReader),
-		func(partIdx int, etag string) {
+	err = uploader.StreamUploadWithUptokenSource(ctx, nil, p.uptokenSource(key, options), key, io.MultiReader(bytes.NewReader(firstPart), bufReader),
+		options.completeMultipart(), func(partIdx int, etag string) {
 			elog.Info("callback", partIdx, etag)
+			tracker.partDone(partIdx, etag)
 		})
+	if err == nil {
+		tracker.done(counter.n)
+	}
 	return err
 }
 
+// 上传失败后是否需要重试，614（对象已存在）等 6xx 错误、579（回调失败）以及除 406 外的 4xx 错误重试也不会成功
+// 406（数据校验失败）通常是传输过程中数据损坏，与 kodocli 的 Put2 一样重试
+func uploadRetryable(err error) bool {
+	code := httputil.DetectCode(err)
+	return code == 406 || code/100 != 4 && code/100 != 6 && code != 579
+}
+
 type readerAtCloser interface {
 	io.ReaderAt
 	io.Closer
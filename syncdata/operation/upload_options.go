@@ -0,0 +1,171 @@
+package operation
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/qiniupd/qiniu-go-sdk/api.v8/kodo"
+	q "github.com/qiniupd/qiniu-go-sdk/api.v8/kodocli"
+	"github.com/qiniupd/qiniu-go-sdk/x/httputil.v1"
+)
+
+// 上传选项
+type UploadOptions struct {
+	// 可选，上传进度通知，可能被并发调用，回调函数应该尽可能快地结束
+	OnProgress func(progress *UploadProgress)
+
+	// 可选，为空时由服务端自动判断
+	MimeType string
+	// 可选，对象的自定义元数据，键不需要带 x-qn-meta- 前缀
+	Metadata map[string]string
+	// 可选，自定义变量，键不带 x: 前缀时会自动补上
+	CustomVars map[string]string
+	// 可选，对象在上传后多少天自动删除，0 表示不删除
+	DeleteAfterDays int
+	// 可选，对象的存储类型
+	FileType kodo.FileType
+	// 为 true 时不覆盖已经存在的对象，结果状态为 UploadStatusExists，不视为错误
+	InsertOnly bool
+	// 为 true 时先获取目标对象的元信息，大小和 etag 都与本地数据一致时跳过上传
+	// 本地 etag 需要完整读取一遍数据，UploadReader 无法预先读取，不支持这个选项
+	SkipIdentical bool
+	// 可选，取消后正在进行的上传会尽快中止并不再重试，为 nil 时使用 context.Background()
+	Context context.Context
+}
+
+// 上传结果状态
+type UploadStatus int
+
+const (
+	// 数据已经上传
+	UploadStatusUploaded UploadStatus = iota
+	// 远端已有相同的对象，跳过上传
+	UploadStatusSkipped
+	// InsertOnly 模式下对象已经存在，没有覆盖
+	UploadStatusExists
+)
+
+func (status UploadStatus) String() string {
+	switch status {
+	case UploadStatusUploaded:
+		return "uploaded"
+	case UploadStatusSkipped:
+		return "skipped"
+	case UploadStatusExists:
+		return "already exists"
+	default:
+		return "unknown"
+	}
+}
+
+// 上传结果
+type UploadResult struct {
+	Key    string
+	Status UploadStatus
+}
+
+// 生成上传策略，options 可以为 nil
+func (options *UploadOptions) putPolicy(bucket, key string) *kodo.PutPolicy {
+	policy := kodo.PutPolicy{
+		Scope:   bucket + ":" + key,
+		Expires: 3600*24 + uint32(time.Now().Unix()),
+	}
+	if options != nil {
+		policy.DeleteAfterDays = options.DeleteAfterDays
+		policy.FileType = options.FileType
+		if options.InsertOnly {
+			policy.InsertOnly = 1
+		}
+	}
+	return &policy
+}
+
+// 生成表单上传的额外参数，总是由 kodocli 计算 CRC32 交给服务端校验，options 可以为 nil
+func (options *UploadOptions) context() context.Context {
+	if options == nil || options.Context == nil {
+		return context.Background()
+	}
+	return options.Context
+}
+
+func (options *UploadOptions) putExtra() *q.PutExtra {
+	if options == nil {
+		return &q.PutExtra{Crc32: q.CalcAndCheckCrc}
+	}
+	return &q.PutExtra{
+		Params:   options.customVars(),
+		XMeta:    options.Metadata,
+		MimeType: options.MimeType,
+		Crc32:    q.CalcAndCheckCrc,
+	}
+}
+
+// 生成分片上传完成时的参数，options 为 nil 时返回 nil
+func (options *UploadOptions) completeMultipart() *q.CompleteMultipart {
+	if options == nil {
+		return nil
+	}
+	return &q.CompleteMultipart{
+		MimeType:   options.MimeType,
+		Metadata:   options.Metadata,
+		CustomVars: options.customVars(),
+	}
+}
+
+func (options *UploadOptions) customVars() map[string]string {
+	if len(options.CustomVars) == 0 {
+		return nil
+	}
+	vars := make(map[string]string, len(options.CustomVars))
+	for k, v := range options.CustomVars {
+		if !strings.HasPrefix(k, "x:") {
+			k = "x:" + k
+		}
+		vars[k] = v
+	}
+	return vars
+}
+
+// 根据选项跳过相同的对象或者在 InsertOnly 模式下识别已经存在的对象，size 为 -1 或 etag 为 nil 时不检查远端对象
+func (p *singleClusterUploader) conditionalUpload(key string, size int64, options *UploadOptions,
+	etag func() (string, error), upload func() error) (*UploadResult, error) {
+	result := UploadResult{Key: key, Status: UploadStatusUploaded}
+	if options != nil && options.SkipIdentical && size >= 0 && etag != nil {
+		stats, err := p.lister.listStat(context.Background(), []string{strings.TrimPrefix(key, "/")})
+		if err != nil {
+			return nil, err
+		}
+		if identical, err := identicalObject(stats[0], size, etag); err != nil {
+			return nil, err
+		} else if identical {
+			result.Status = UploadStatusSkipped
+			return &result, nil
+		}
+	}
+	if err := upload(); err != nil {
+		if options != nil && options.InsertOnly && httputil.DetectCode(err) == 614 {
+			result.Status = UploadStatusExists
+			return &result, nil
+		}
+		return nil, err
+	}
+	return &result, nil
+}
+
+// 远端对象存在，并且大小和 etag 与本地数据一致
+func identicalObject(stat *FileStat, size int64, etag func() (string, error)) (bool, error) {
+	if stat == nil || stat.code == 612 {
+		return false, nil
+	} else if stat.code != 200 {
+		return false, fmt.Errorf("stat failed with code %d", stat.code)
+	} else if stat.Size != size {
+		return false, nil
+	}
+	localEtag, err := etag()
+	if err != nil {
+		return false, err
+	}
+	return localEtag == stat.Hash, nil
+}
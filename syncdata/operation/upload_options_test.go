@@ -0,0 +1,139 @@
+package operation
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	q "github.com/qiniupd/qiniu-go-sdk/api.v8/kodocli"
+	"github.com/qiniupd/qiniu-go-sdk/x/rpc.v7"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUploadOptions(t *testing.T) {
+	var options *UploadOptions
+	policy := options.putPolicy("bucket", "key")
+	assert.Equal(t, "bucket:key", policy.Scope)
+	assert.Equal(t, uint16(0), policy.InsertOnly)
+	assert.Equal(t, uint32(q.CalcAndCheckCrc), options.putExtra().Crc32)
+	assert.Nil(t, options.completeMultipart())
+
+	options = &UploadOptions{
+		MimeType:        "text/plain",
+		Metadata:        map[string]string{"owner": "miner"},
+		CustomVars:      map[string]string{"x:a": "1", "b": "2"},
+		DeleteAfterDays: 7,
+		FileType:        1,
+		InsertOnly:      true,
+	}
+	policy = options.putPolicy("bucket", "key")
+	assert.Equal(t, 7, policy.DeleteAfterDays)
+	assert.Equal(t, uint32(1), uint32(policy.FileType))
+	assert.Equal(t, uint16(1), policy.InsertOnly)
+
+	extra := options.putExtra()
+	assert.Equal(t, "text/plain", extra.MimeType)
+	assert.Equal(t, uint32(q.CalcAndCheckCrc), extra.Crc32)
+	assert.Equal(t, map[string]string{"owner": "miner"}, extra.XMeta)
+	assert.Equal(t, map[string]string{"x:a": "1", "x:b": "2"}, extra.Params)
+
+	mp := options.completeMultipart()
+	assert.Equal(t, "text/plain", mp.MimeType)
+	assert.Equal(t, map[string]string{"owner": "miner"}, mp.Metadata)
+	assert.Equal(t, map[string]string{"x:a": "1", "x:b": "2"}, mp.CustomVars)
+}
+
+func TestIdenticalObject(t *testing.T) {
+	etag := func() (string, error) { return "etag", nil }
+	failedEtag := func() (string, error) { return "", errors.New("read failed") }
+
+	identical, err := identicalObject(nil, 10, etag)
+	assert.NoError(t, err)
+	assert.False(t, identical)
+
+	identical, err = identicalObject(&FileStat{code: 612}, 10, etag)
+	assert.NoError(t, err)
+	assert.False(t, identical)
+
+	_, err = identicalObject(&FileStat{code: 599}, 10, etag)
+	assert.Error(t, err)
+
+	identical, err = identicalObject(&FileStat{code: 200, Size: 9, Hash: "etag"}, 10, failedEtag)
+	assert.NoError(t, err)
+	assert.False(t, identical)
+
+	identical, err = identicalObject(&FileStat{code: 200, Size: 10, Hash: "other"}, 10, etag)
+	assert.NoError(t, err)
+	assert.False(t, identical)
+
+	identical, err = identicalObject(&FileStat{code: 200, Size: 10, Hash: "etag"}, 10, etag)
+	assert.NoError(t, err)
+	assert.True(t, identical)
+
+	_, err = identicalObject(&FileStat{code: 200, Size: 10, Hash: "etag"}, 10, failedEtag)
+	assert.Error(t, err)
+}
+
+func TestInsertOnlyUploadOfExistingKey(t *testing.T) {
+	var puts, completes int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		paths := strings.Split(strings.TrimPrefix(r.URL.Path, "/"), "/")
+		body, _ := ioutil.ReadAll(r.Body)
+		switch {
+		case paths[0] == "put":
+			atomic.AddInt32(&puts, 1)
+			w.WriteHeader(614)
+			json.NewEncoder(w).Encode(map[string]string{"error": "file exists"})
+		case r.Method == "POST" && len(paths) == 5:
+			json.NewEncoder(w).Encode(map[string]string{"uploadId": "upload-id"})
+		case r.Method == "PUT":
+			sum := md5.Sum(body)
+			json.NewEncoder(w).Encode(q.UploadPartRet{Etag: "etag", Md5: hex.EncodeToString(sum[:])})
+		case r.Method == "POST" && len(paths) == 6:
+			atomic.AddInt32(&completes, 1)
+			w.WriteHeader(614)
+			json.NewEncoder(w).Encode(map[string]string{"error": "file exists"})
+		default:
+			json.NewEncoder(w).Encode(map[string]string{})
+		}
+	}))
+	defer server.Close()
+
+	dirPath, err := ioutil.TempDir("", "upload")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dirPath)
+	file := filepath.Join(dirPath, "large")
+	assert.NoError(t, ioutil.WriteFile(file, make([]byte, 4*1024*1024+1), 0644))
+
+	uploader := NewUploader(&Config{UpHosts: []string{server.URL}, Bucket: "bucket", Ak: "ak", Sk: "sk", UpConcurrency: 1})
+	options := &UploadOptions{InsertOnly: true}
+
+	result, err := uploader.UploadDataWithOptions([]byte("data"), "key", options)
+	assert.NoError(t, err)
+	assert.Equal(t, UploadStatusExists, result.Status)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&puts))
+
+	result, err = uploader.UploadWithOptions(file, "key", options)
+	assert.NoError(t, err)
+	assert.Equal(t, UploadStatusExists, result.Status)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&completes))
+}
+
+func TestUploadRetryable(t *testing.T) {
+	assert.True(t, uploadRetryable(errors.New("connection reset")))
+	assert.True(t, uploadRetryable(&rpc.ErrorInfo{Code: 406}))
+	assert.True(t, uploadRetryable(&rpc.ErrorInfo{Code: 503}))
+	assert.False(t, uploadRetryable(&rpc.ErrorInfo{Code: 401}))
+	assert.False(t, uploadRetryable(&rpc.ErrorInfo{Code: 579}))
+	assert.False(t, uploadRetryable(&rpc.ErrorInfo{Code: 614}))
+}
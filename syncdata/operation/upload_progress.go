@@ -0,0 +1,202 @@
+package operation
+
+import (
+	"sync"
+
+	q "github.com/qiniupd/qiniu-go-sdk/api.v8/kodocli"
+)
+
+// 上传进度
+type UploadProgress struct {
+	Key string
+	// 已经发送的字节数，重试时会扣除失败分片已发送的部分
+	BytesSent int64
+	// 总字节数，流式上传结束前为 -1
+	TotalBytes int64
+	// 已经完成的分片数，表单上传完成时为 1
+	PartsDone int
+	// 当前正在使用的上传域名
+	Host string
+	// 累计重试次数，包括分片重试和整体重试
+	Retries int
+}
+
+// 汇总 kodocli 的分片事件，转换为 UploadProgress 通知
+type uploadProgressTracker struct {
+	lock       sync.Mutex
+	progress   UploadProgress
+	partsSent  map[int]int64
+	onProgress func(progress *UploadProgress)
+}
+
+func newUploadProgressTracker(key string, total int64, options *UploadOptions) *uploadProgressTracker {
+	if options == nil || options.OnProgress == nil {
+		return nil
+	}
+	return &uploadProgressTracker{
+		progress:   UploadProgress{Key: key, TotalBytes: total},
+		partsSent:  make(map[int]int64),
+		onProgress: options.OnProgress,
+	}
+}
+
+// 为 kodocli 上传器设置回调，tracker 为 nil 时不做任何事
+func (t *uploadProgressTracker) attach(uploader *q.Uploader) {
+	if t == nil {
+		return
+	}
+	uploader.OnPartProgress = t.partProgress
+	uploader.OnPartRetry = t.partRetry
+}
+
+func (t *uploadProgressTracker) partProgress(partNum int, upHost string, uploaded int64) {
+	t.update(func(progress *UploadProgress) {
+		progress.BytesSent += uploaded - t.partsSent[partNum]
+		t.partsSent[partNum] = uploaded
+		progress.Host = upHost
+	})
+}
+
+func (t *uploadProgressTracker) partRetry(partNum int, upHost string, err error) {
+	t.update(func(progress *UploadProgress) {
+		progress.BytesSent -= t.partsSent[partNum]
+		delete(t.partsSent, partNum)
+		progress.Retries++
+	})
+}
+
+// 分片上传完成
+func (t *uploadProgressTracker) partDone(partNum int, etag string) {
+	if t == nil {
+		return
+	}
+	t.update(func(progress *UploadProgress) {
+		progress.PartsDone++
+	})
+}
+
+// 整体重试，已发送的数据全部作废
+func (t *uploadProgressTracker) retry() {
+	if t == nil {
+		return
+	}
+	t.update(func(progress *UploadProgress) {
+		progress.BytesSent = 0
+		progress.PartsDone = 0
+		progress.Retries++
+		t.partsSent = make(map[int]int64)
+	})
+}
+
+// 流式上传读取数据后才能确定总大小，只更新状态，不触发回调
+func (t *uploadProgressTracker) setTotal(total int64) {
+	if t == nil {
+		return
+	}
+	t.lock.Lock()
+	t.progress.TotalBytes = total
+	t.lock.Unlock()
+}
+
+// 上传成功，total 为实际上传的字节数
+func (t *uploadProgressTracker) done(total int64) {
+	if t == nil {
+		return
+	}
+	t.update(func(progress *UploadProgress) {
+		progress.BytesSent = total
+		progress.TotalBytes = total
+		if progress.PartsDone == 0 {
+			progress.PartsDone = 1
+		}
+	})
+}
+
+func (t *uploadProgressTracker) update(fn func(progress *UploadProgress)) {
+	t.lock.Lock()
+	fn(&t.progress)
+	progress := t.progress
+	t.lock.Unlock()
+	t.onProgress(&progress)
+}
+
+// 按上传域名统计上传成功的字节数，每个分片只计算最后一次尝试发送的部分
+// 失败或者被重试的尝试已经发送的字节数单独统计
+type uploadHostBytes struct {
+	lock      sync.Mutex
+	parts     map[int]partSent
+	discarded map[string]int64
+}
+
+type partSent struct {
+	host string
+	sent int64
+}
+
+func newUploadHostBytes() *uploadHostBytes {
+	return &uploadHostBytes{parts: make(map[int]partSent), discarded: make(map[string]int64)}
+}
+
+// 在 kodocli 上传器已有的 OnPartProgress、OnPartRetry 回调之前统计，需要在 uploadProgressTracker.attach 之后调用
+func (b *uploadHostBytes) attach(uploader *q.Uploader) {
+	nextProgress := uploader.OnPartProgress
+	uploader.OnPartProgress = func(partNum int, upHost string, uploaded int64) {
+		b.lock.Lock()
+		// 换了域名或者已发送的字节数变少说明是新的一次尝试，kodocli 内部重试时不一定调用 OnPartRetry
+		if part, ok := b.parts[partNum]; ok && (part.host != upHost || uploaded < part.sent) {
+			b.discarded[part.host] += part.sent
+		}
+		b.parts[partNum] = partSent{host: upHost, sent: uploaded}
+		b.lock.Unlock()
+		if nextProgress != nil {
+			nextProgress(partNum, upHost, uploaded)
+		}
+	}
+	nextRetry := uploader.OnPartRetry
+	uploader.OnPartRetry = func(partNum int, upHost string, err error) {
+		b.lock.Lock()
+		b.discardPart(partNum)
+		b.lock.Unlock()
+		if nextRetry != nil {
+			nextRetry(partNum, upHost, err)
+		}
+	}
+}
+
+// 调用时需持有锁
+func (b *uploadHostBytes) discardPart(partNum int) {
+	if part, ok := b.parts[partNum]; ok {
+		b.discarded[part.host] += part.sent
+		delete(b.parts, partNum)
+	}
+}
+
+// 整体重试，已发送的数据全部作废
+func (b *uploadHostBytes) reset() {
+	b.lock.Lock()
+	for partNum := range b.parts {
+		b.discardPart(partNum)
+	}
+	b.lock.Unlock()
+}
+
+// 上传结束后按域名记录字节数，上传失败时已发送的字节数全部记为作废
+func (b *uploadHostBytes) record(m *Metrics, operation string, succeed bool) {
+	if !succeed {
+		b.reset()
+	}
+	b.lock.Lock()
+	hosts := make(map[string]int64)
+	for _, part := range b.parts {
+		hosts[part.host] += part.sent
+	}
+	discarded := b.discarded
+	b.discarded = make(map[string]int64)
+	b.lock.Unlock()
+	for host, n := range hosts {
+		m.recordBytes(operation, host, n)
+	}
+	for host, n := range discarded {
+		m.recordDiscardedBytes(operation, host, n)
+	}
+}
@@ -0,0 +1,95 @@
+package operation
+
+import (
+	"errors"
+	"testing"
+
+	q "github.com/qiniupd/qiniu-go-sdk/api.v8/kodocli"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUploadProgressTracker(t *testing.T) {
+	assert.Nil(t, newUploadProgressTracker("key", 10, nil))
+	assert.Nil(t, newUploadProgressTracker("key", 10, &UploadOptions{}))
+
+	var last UploadProgress
+	tracker := newUploadProgressTracker("key", 100, &UploadOptions{OnProgress: func(progress *UploadProgress) {
+		last = *progress
+	}})
+	var uploader q.Uploader
+	tracker.attach(&uploader)
+
+	uploader.OnPartProgress(1, "http://up1", 30)
+	uploader.OnPartProgress(2, "http://up2", 20)
+	assert.Equal(t, UploadProgress{Key: "key", BytesSent: 50, TotalBytes: 100, Host: "http://up2"}, last)
+
+	uploader.OnPartRetry(2, "http://up2", errors.New("failed"))
+	assert.Equal(t, int64(30), last.BytesSent)
+	assert.Equal(t, 1, last.Retries)
+
+	uploader.OnPartProgress(1, "http://up1", 50)
+	tracker.partDone(1, "etag")
+	assert.Equal(t, int64(50), last.BytesSent)
+	assert.Equal(t, 1, last.PartsDone)
+
+	tracker.retry()
+	assert.Equal(t, UploadProgress{Key: "key", TotalBytes: 100, Host: "http://up1", Retries: 2}, last)
+
+	tracker.done(100)
+	assert.Equal(t, UploadProgress{Key: "key", BytesSent: 100, TotalBytes: 100, PartsDone: 1, Host: "http://up1", Retries: 2}, last)
+
+	tracker.setTotal(-1)
+	uploader.OnPartProgress(1, "http://up1", 60)
+	assert.Equal(t, int64(-1), last.TotalBytes)
+
+	var nilTracker *uploadProgressTracker
+	nilTracker.setTotal(10)
+}
+
+func TestUploadHostBytes(t *testing.T) {
+	var last UploadProgress
+	tracker := newUploadProgressTracker("key", 100, &UploadOptions{OnProgress: func(progress *UploadProgress) {
+		last = *progress
+	}})
+	hostBytes := newUploadHostBytes()
+	var uploader q.Uploader
+	tracker.attach(&uploader)
+	hostBytes.attach(&uploader)
+
+	uploader.OnPartProgress(1, "http://up1", 30)
+	uploader.OnPartProgress(2, "http://up1", 20)
+	assert.Equal(t, int64(50), last.BytesSent)
+	hostBytes.reset()
+
+	// 分片重试换了域名时只计算最后一次尝试
+	uploader.OnPartProgress(1, "http://up1", 60)
+	uploader.OnPartProgress(2, "http://up1", 10)
+	uploader.OnPartProgress(2, "http://up2", 40)
+
+	m := NewMetrics()
+	hostBytes.record(m, "upload_file", true)
+	assert.Equal(t, map[string]float64{"http://up1": 60, "http://up2": 40}, hostSamples(m, "qiniu_operation_bytes_total"))
+	// 整体重试前发送的 50 字节以及分片 2 在 up1 上发送的 10 字节被作废
+	assert.Equal(t, map[string]float64{"http://up1": 60}, hostSamples(m, "qiniu_operation_discarded_bytes_total"))
+
+	// 分片重试以及整个上传失败时发送的字节数都记为作废
+	hostBytes = newUploadHostBytes()
+	hostBytes.attach(&uploader)
+	uploader.OnPartProgress(1, "http://up1", 30)
+	uploader.OnPartRetry(1, "http://up1", errors.New("failed"))
+	uploader.OnPartProgress(1, "http://up2", 20)
+	m = NewMetrics()
+	hostBytes.record(m, "upload_file", false)
+	assert.Empty(t, hostSamples(m, "qiniu_operation_bytes_total"))
+	assert.Equal(t, map[string]float64{"http://up1": 30, "http://up2": 20}, hostSamples(m, "qiniu_operation_discarded_bytes_total"))
+}
+
+func hostSamples(m *Metrics, name string) map[string]float64 {
+	values := make(map[string]float64)
+	for _, sample := range m.Samples() {
+		if sample.Name == name {
+			values[sample.Labels["host"]] = sample.Value
+		}
+	}
+	return values
+}
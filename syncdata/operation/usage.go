@@ -0,0 +1,103 @@
+package operation
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/qiniupd/qiniu-go-sdk/api.v7/kodo"
+)
+
+// 前缀下的对象数量和总字节数
+type PrefixUsage struct {
+	Prefix string `json:"prefix"`
+	Count  int64  `json:"count"`
+	Bytes  int64  `json:"bytes"`
+}
+
+// 统计指定前缀下的对象数量和总字节数，只列举一次，不需要逐个获取对象元信息
+// depth 为 0 时只返回前缀本身的统计，depth 为 n 时按前缀之后的前 n 级目录（以 / 分隔）分组统计，
+// 层级不足 n 的对象计入其所在的最深一级目录。结果按前缀排序，多集群模式下会合并所有集群的统计
+func (l *Lister) Usage(ctx context.Context, prefix string, depth int) ([]*PrefixUsage, error) {
+	var (
+		usages     = make(map[string]*PrefixUsage)
+		usagesLock sync.Mutex
+	)
+	merge := func(clusterUsages map[string]*PrefixUsage) {
+		usagesLock.Lock()
+		defer usagesLock.Unlock()
+		for p, usage := range clusterUsages {
+			if u, ok := usages[p]; ok {
+				u.Count += usage.Count
+				u.Bytes += usage.Bytes
+			} else {
+				usages[p] = usage
+			}
+		}
+	}
+
+	if l.singleClusterLister != nil {
+		clusterUsages, err := l.singleClusterLister.usage(ctx, prefix, depth)
+		if err != nil {
+			return nil, err
+		}
+		merge(clusterUsages)
+	} else {
+		pool := newGoroutinePool(l.multiClustersConcurrency)
+		l.config.forEachClusterConfig(func(_ string, config *Config) error {
+			pool.Go(func(ctx context.Context) error {
+				clusterUsages, err := newSingleClusterLister(config).usage(ctx, prefix, depth)
+				if err != nil {
+					return err
+				}
+				merge(clusterUsages)
+				return nil
+			})
+			return nil
+		})
+		if err := pool.Wait(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	result := make([]*PrefixUsage, 0, len(usages))
+	for _, usage := range usages {
+		result = append(result, usage)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Prefix < result[j].Prefix })
+	return result, nil
+}
+
+func (l *singleClusterLister) usage(ctx context.Context, prefix string, depth int) (map[string]*PrefixUsage, error) {
+	usages := make(map[string]*PrefixUsage)
+	err := l.rangePrefix(ctx, prefix, func(item kodo.ListItem) error {
+		p := usagePrefix(prefix, item.Key, depth)
+		usage, ok := usages[p]
+		if !ok {
+			usage = &PrefixUsage{Prefix: p}
+			usages[p] = usage
+		}
+		usage.Count++
+		usage.Bytes += item.Fsize
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return usages, nil
+}
+
+// 获取对象在指定深度下所属的前缀
+func usagePrefix(prefix, key string, depth int) string {
+	rest := strings.TrimPrefix(key, prefix)
+	end := 0
+	for i := 0; i < depth; i++ {
+		index := strings.Index(rest[end:], "/")
+		if index < 0 {
+			break
+		}
+		end += index + 1
+	}
+	return prefix + rest[:end]
+}
@@ -0,0 +1,17 @@
+package operation
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUsagePrefix(t *testing.T) {
+	assert.Equal(t, usagePrefix("data/", "data/a/b/c.txt", 0), "data/")
+	assert.Equal(t, usagePrefix("data/", "data/a/b/c.txt", 1), "data/a/")
+	assert.Equal(t, usagePrefix("data/", "data/a/b/c.txt", 2), "data/a/b/")
+	assert.Equal(t, usagePrefix("data/", "data/a/b/c.txt", 3), "data/a/b/")
+	assert.Equal(t, usagePrefix("data/", "data/c.txt", 1), "data/")
+	assert.Equal(t, usagePrefix("", "a/b", 1), "a/")
+	assert.Equal(t, usagePrefix("da", "data/a/b", 1), "data/")
+}